@@ -0,0 +1,360 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	accessRulesKey  = "accessRules"
+	accessSecretKey = "accessSecret"
+
+	accessAllow     = "allow"
+	accessDeny      = "deny"
+	accessChallenge = "challenge"
+
+	challengeCookie = "portm-challenge"
+)
+
+// accessRule matches the request by all the non-empty conditions
+type accessRule struct {
+	ID      string            `json:"id"`
+	Host    string            `json:"host,omitempty"`    // regexp of the host
+	Path    string            `json:"path,omitempty"`    // regexp of the path
+	Methods []string          `json:"methods,omitempty"` // such as ["POST", "PUT"]
+	IPs     []string          `json:"ips,omitempty"`     // client ips or CIDRs, such as ["10.0.0.1", "192.168.0.0/16"]
+	Headers map[string]string `json:"headers,omitempty"` // header name -> regexp of the value
+	Action  string            `json:"action"`            // "allow", "deny" or "challenge"
+	Hits    uint64            `json:"hits"`
+
+	prefix     string // the uri prefix of the blackList option
+	hostReg    *regexp.Regexp
+	pathReg    *regexp.Regexp
+	nets       []*net.IPNet
+	headerRegs map[string]*regexp.Regexp
+}
+
+// accessTable checks the requests of the file service, the first matched rule wins,
+// the request matches no rule is allowed
+type accessTable struct {
+	lock   *sync.RWMutex
+	rules  []*accessRule
+	secret []byte // to sign the challenge cookie
+}
+
+func newAccessTable() *accessTable {
+	table := &accessTable{
+		lock:  &sync.RWMutex{},
+		rules: []*accessRule{},
+	}
+
+	data, err := db.Get([]byte(accessRulesKey), nil)
+	if err == nil {
+		table.rules, err = parseAccessRules(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	table.secret, err = db.Get([]byte(accessSecretKey), nil)
+	if err != nil {
+		secret, err := randomHex(32)
+		if err != nil {
+			panic(err)
+		}
+		table.secret = []byte(secret)
+		db.Put([]byte(accessSecretKey), table.secret, nil)
+	}
+
+	return table
+}
+
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid ip: " + s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+func parseAccessRules(data []byte) ([]*accessRule, error) {
+	rules := []*accessRule{}
+
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]bool{}
+
+	for _, rule := range rules {
+		if rule == nil {
+			return nil, errors.New("access rule is null")
+		}
+
+		if rule.ID == "" || ids[rule.ID] {
+			return nil, errors.New("access rule id should be unique and not empty: " + rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.Action != accessAllow && rule.Action != accessDeny && rule.Action != accessChallenge {
+			return nil, errors.New("access rule action should be allow, deny or challenge: " + rule.ID)
+		}
+
+		rule.hostReg, err = regexp.Compile(rule.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.pathReg, err = regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, method := range rule.Methods {
+			rule.Methods[i] = strings.ToUpper(method)
+		}
+
+		for _, s := range rule.IPs {
+			ipNet, err := parseIPNet(s)
+			if err != nil {
+				return nil, err
+			}
+			rule.nets = append(rule.nets, ipNet)
+		}
+
+		rule.headerRegs = map[string]*regexp.Regexp{}
+		for name, value := range rule.Headers {
+			rule.headerRegs[name], err = regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// replace the rules and persist them, the hits of the rules with the same id are kept
+func (table *accessTable) set(data []byte) error {
+	rules, err := parseAccessRules(data)
+	if err != nil {
+		return err
+	}
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	hits := map[string]uint64{}
+	for _, rule := range table.rules {
+		hits[rule.ID] = atomic.LoadUint64(&rule.Hits)
+	}
+	for _, rule := range rules {
+		rule.Hits = hits[rule.ID]
+	}
+
+	data, _ = json.Marshal(rules)
+	err = db.Put([]byte(accessRulesKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	table.rules = rules
+	return nil
+}
+
+func (table *accessTable) resetHits(blacklist []*accessRule) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	for _, list := range [][]*accessRule{table.rules, blacklist} {
+		for _, rule := range list {
+			atomic.StoreUint64(&rule.Hits, 0)
+		}
+	}
+}
+
+func (rule *accessRule) match(ctx *fasthttp.RequestCtx, uri string) bool {
+	if rule.prefix != "" {
+		return strings.HasPrefix(uri, rule.prefix)
+	}
+
+	if !rule.hostReg.MatchString(string(ctx.Host())) || !rule.pathReg.MatchString(string(ctx.Path())) {
+		return false
+	}
+
+	if len(rule.Methods) > 0 {
+		method := string(ctx.Method())
+		has := false
+		for _, m := range rule.Methods {
+			if m == method {
+				has = true
+				break
+			}
+		}
+		if !has {
+			return false
+		}
+	}
+
+	if len(rule.nets) > 0 {
+		ip := ctx.RemoteIP()
+		has := false
+		for _, ipNet := range rule.nets {
+			if ipNet.Contains(ip) {
+				has = true
+				break
+			}
+		}
+		if !has {
+			return false
+		}
+	}
+
+	for name, reg := range rule.headerRegs {
+		if !reg.Match(ctx.Request.Header.Peek(name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// the first matched rule, the rules of the blackList option are checked after the ones in db
+func (table *accessTable) match(ctx *fasthttp.RequestCtx, uri string, blacklist []*accessRule) *accessRule {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	for _, list := range [][]*accessRule{table.rules, blacklist} {
+		for _, rule := range list {
+			if rule.match(ctx, uri) {
+				atomic.AddUint64(&rule.Hits, 1)
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// the rules in db and the ones of the blackList option with their hits
+func (table *accessTable) marshal(blacklist []*accessRule) []byte {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"rules":     copyAccessRules(table.rules),
+		"blackList": copyAccessRules(blacklist),
+	})
+	return data
+}
+
+// the rules are copied field by field, the hits are being updated by the requests
+func copyAccessRules(rules []*accessRule) []accessRule {
+	list := make([]accessRule, len(rules))
+	for i, rule := range rules {
+		list[i] = accessRule{
+			ID:      rule.ID,
+			Host:    rule.Host,
+			Path:    rule.Path,
+			Methods: rule.Methods,
+			IPs:     rule.IPs,
+			Headers: rule.Headers,
+			Action:  rule.Action,
+			Hits:    atomic.LoadUint64(&rule.Hits),
+		}
+	}
+	return list
+}
+
+// the challenge cookie is bound to the client ip
+func (table *accessTable) challengeToken(ip net.IP) string {
+	mac := hmac.New(sha256.New, table.secret)
+	mac.Write([]byte(ip.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the prefixes of the deprecated blackList option, they are denied
+func newBlacklistRules(prefixes []string) []*accessRule {
+	rules := []*accessRule{}
+	for _, prefix := range prefixes {
+		if prefix != "" {
+			rules = append(rules, &accessRule{ID: "blackList:" + prefix, Action: accessDeny, prefix: prefix})
+		}
+	}
+	return rules
+}
+
+const challengePage = `<html><body><script>
+document.cookie = "` + challengeCookie + `={token}; path=/; max-age=86400";
+location.reload();
+</script></body></html>`
+
+// Returns false if the request is denied or challenged.
+func (appCtx *AppContext) checkAccess(ctx *fasthttp.RequestCtx, uri string) bool {
+	rule := appCtx.access.match(ctx, uri, appCtx.conf().blacklist)
+
+	if rule == nil || rule.Action == accessAllow {
+		return true
+	}
+
+	if rule.Action == accessChallenge {
+		token := appCtx.access.challengeToken(ctx.RemoteIP())
+		if hmac.Equal(ctx.Request.Header.Cookie(challengeCookie), []byte(token)) {
+			return true
+		}
+
+		appCtx.reqCount.chStatusCode <- statusForbiden
+		ctx.SetStatusCode(statusForbiden)
+		ctx.SetContentType("text/html; charset=utf-8")
+		ctx.Response.Header.Set("Cache-Control", "no-store")
+		ctx.WriteString(strings.Replace(challengePage, "{token}", token, 1))
+		return false
+	}
+
+	appCtx.reqCount.chStatusCode <- statusForbiden
+	ctx.SetStatusCode(statusForbiden)
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.WriteString("Forbidden")
+	return false
+}
+
+// curl 127.0.0.1:7071/access-rules
+// curl -d '[{"id": "office", "ips": ["10.0.0.0/8"], "action": "allow"}, {"id": "admin", "path": "^/admin", "action": "deny"}]' 127.0.0.1:7071/access-rules
+// curl 127.0.0.1:7071/access-rules?action=reset-hits
+func (appCtx *AppContext) handleAccessRules(ctx *fasthttp.RequestCtx) {
+	var err error
+
+	if ctx.IsPost() {
+		err = appCtx.access.set(ctx.PostBody())
+	} else if string(ctx.QueryArgs().Peek("action")) == "reset-hits" {
+		appCtx.access.resetHits(appCtx.conf().blacklist)
+	}
+
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(appCtx.access.marshal(appCtx.conf().blacklist))
+}
@@ -0,0 +1,346 @@
+package lib
+
+import (
+	"bufio"
+	gz "compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// the user values of the RequestCtx for the access log
+const (
+	cacheStatusKey = "portalCacheStatus"
+	gispCostKey    = "portalGispCost"
+)
+
+// the cache status of the file
+const (
+	cacheHit      = "hit"
+	cacheStale    = "stale"
+	cacheMiss     = "miss"
+	cacheOverload = "overload"
+)
+
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	Duration  float64   `json:"duration"` // ms
+	Cache     string    `json:"cache,omitempty"`
+	Cost      float64   `json:"cost,omitempty"` // ms of the gisp run
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent"`
+}
+
+// accessLog writes a line for every request of the file service in background,
+// the file is rotated by size and age, the rotated ones are gzipped
+type accessLog struct {
+	path       string // "-" for the stdout
+	format     string // "json" or "combined"
+	maxSize    int64
+	rotateSpan time.Duration
+	maxBackups int
+
+	ch      chan *accessRecord
+	chFlush chan chan bool
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	opened  time.Time
+	dropped uint64
+}
+
+func newAccessLog(path string, format string, maxSize int64, rotateSpan time.Duration, maxBackups int) *accessLog {
+	if path == "" {
+		return nil
+	}
+
+	l := &accessLog{
+		path:       path,
+		format:     format,
+		maxSize:    maxSize,
+		rotateSpan: rotateSpan,
+		maxBackups: maxBackups,
+		ch:         make(chan *accessRecord, 10000),
+		chFlush:    make(chan chan bool),
+	}
+
+	err := l.open()
+	if err != nil {
+		panic(err)
+	}
+
+	go l.worker()
+
+	return l
+}
+
+func (l *accessLog) open() error {
+	if l.path == "-" {
+		l.file = os.Stdout
+	} else {
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		l.file = f
+		l.size = info.Size()
+	}
+
+	l.writer = bufio.NewWriterSize(l.file, 64*1024)
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *accessLog) worker() {
+	for {
+		select {
+		case record := <-l.ch:
+			l.write(record)
+
+			if len(l.ch) == 0 {
+				l.writer.Flush()
+			}
+
+		case done := <-l.chFlush:
+			for len(l.ch) > 0 {
+				l.write(<-l.ch)
+			}
+			l.writer.Flush()
+			done <- true
+		}
+	}
+}
+
+func (l *accessLog) write(record *accessRecord) {
+	line := l.formatRecord(record)
+
+	if l.path != "-" && (l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize ||
+		l.rotateSpan > 0 && time.Since(l.opened) >= l.rotateSpan) {
+		err := l.rotate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "rotate access log error:\n"+err.Error())
+		}
+	}
+
+	n, _ := l.writer.Write(line)
+	l.size += int64(n)
+}
+
+func (l *accessLog) formatRecord(record *accessRecord) []byte {
+	if l.format == "combined" {
+		bytes := "-"
+		if record.Bytes > 0 {
+			bytes = strconv.Itoa(record.Bytes)
+		}
+
+		referer := record.Referer
+		if referer == "" {
+			referer = "-"
+		}
+
+		// the standard combined format, with the duration, cache status and gisp cost appended
+		return []byte(fmt.Sprintf("%s - - [%s] %q %d %s %q %q rt=%.3f cache=%s cost=%.3f\n",
+			record.IP,
+			record.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			record.Method+" "+record.URI+" HTTP/1.1",
+			record.Status,
+			bytes,
+			referer,
+			record.UserAgent,
+			record.Duration/1000,
+			record.Cache,
+			record.Cost/1000,
+		))
+	}
+
+	data, _ := json.Marshal(record)
+	return append(data, '\n')
+}
+
+// the name of the rotated file, the time is moved forward if the name is taken,
+// so that the names are unique and sorted by time
+func (l *accessLog) rotatedName() string {
+	t := time.Now()
+	for {
+		name := l.path + "." + t.Format("20060102-150405.000")
+
+		_, err := os.Stat(name)
+		_, gzErr := os.Stat(name + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return name
+		}
+
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// rename the current file with the time, then gzip it in background
+func (l *accessLog) rotate() error {
+	l.writer.Flush()
+	l.file.Close()
+
+	name := l.rotatedName()
+	err := os.Rename(l.path, name)
+
+	openErr := l.open()
+	if openErr != nil {
+		// keep the writer usable, the lines are dropped until the next rotation
+		l.writer = bufio.NewWriter(ioutil.Discard)
+		return openErr
+	}
+	l.size = 0
+
+	if err != nil {
+		return err
+	}
+
+	go l.compress(name)
+
+	return nil
+}
+
+func (l *accessLog) compress(name string) {
+	err := gzipFile(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "compress access log error:\n"+err.Error())
+		return
+	}
+
+	if l.maxBackups < 1 {
+		return
+	}
+
+	list, _ := filepath.Glob(l.path + ".*.gz")
+	sort.Strings(list)
+
+	for len(list) > l.maxBackups {
+		os.Remove(list[0])
+		list = list[1:]
+	}
+}
+
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+
+	w := gz.NewWriter(dst)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// write the records in the queue to the file
+func (l *accessLog) flush(timeout time.Duration) error {
+	done := make(chan bool, 1)
+
+	select {
+	case l.chFlush <- done:
+	case <-time.After(timeout):
+		return errors.New("access log flush timeout")
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("access log flush timeout")
+	}
+}
+
+func (l *accessLog) status() map[string]interface{} {
+	if l == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"path":    l.path,
+		"format":  l.format,
+		"queue":   len(l.ch),
+		"dropped": atomic.LoadUint64(&l.dropped),
+	}
+}
+
+// the record is dropped if the queue is full, so that the requests won't be blocked by the disk
+func (appCtx *AppContext) logAccess(ctx *fasthttp.RequestCtx, start time.Time) {
+	l := appCtx.accessLog
+	if l == nil {
+		return
+	}
+
+	size := ctx.Response.Header.ContentLength()
+	if !ctx.Response.IsBodyStream() {
+		size = len(ctx.Response.Body())
+	}
+
+	// the length of the streamed body is negative if it's unknown
+	if size < 0 {
+		size = 0
+	}
+
+	record := &accessRecord{
+		Time:      start,
+		IP:        ctx.RemoteIP().String(),
+		Method:    string(ctx.Method()),
+		Host:      string(ctx.Host()),
+		URI:       string(ctx.RequestURI()),
+		Status:    ctx.Response.StatusCode(),
+		Bytes:     size,
+		Duration:  float64(time.Since(start)) / float64(time.Millisecond),
+		Referer:   string(ctx.Referer()),
+		UserAgent: string(ctx.UserAgent()),
+	}
+
+	if status, ok := ctx.UserValue(cacheStatusKey).(string); ok {
+		record.Cache = status
+	}
+	if cost, ok := ctx.UserValue(gispCostKey).(uint64); ok {
+		record.Cost = float64(cost) / float64(time.Millisecond)
+	}
+
+	select {
+	case l.ch <- record:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
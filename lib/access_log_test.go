@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAccessLogFormat(t *testing.T) {
+	record := &accessRecord{
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		IP:        "1.2.3.4",
+		Method:    "GET",
+		URI:       "/a?b=1",
+		Status:    200,
+		Bytes:     10,
+		Duration:  12,
+		Cache:     cacheHit,
+		UserAgent: "curl",
+	}
+
+	l := &accessLog{format: "combined"}
+	assert.Equal(t,
+		`1.2.3.4 - - [02/Jan/2020:03:04:05 +0000] "GET /a?b=1 HTTP/1.1" 200 10 "-" "curl" rt=0.012 cache=hit cost=0.000`+"\n",
+		string(l.formatRecord(record)),
+	)
+
+	l.format = "json"
+	assert.Contains(t, string(l.formatRecord(record)), `"cache":"hit"`)
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "portal-access-log")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	l := newAccessLog(path, "json", 300, 0, 2)
+
+	for i := 0; i < 3; i++ {
+		l.ch <- &accessRecord{URI: strings.Repeat("a", 200)}
+		assert.Nil(t, l.flush(time.Second))
+	}
+
+	var list []string
+	for i := 0; i < 100; i++ {
+		list, _ = filepath.Glob(path + ".*")
+		if len(list) == 2 && strings.HasSuffix(list[0], ".gz") && strings.HasSuffix(list[1], ".gz") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Len(t, list, 2)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+}
+
+func TestLogAccessStream(t *testing.T) {
+	// the records are read from the queue without the worker
+	appCtx := &AppContext{accessLog: &accessLog{ch: make(chan *accessRecord, 1)}}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetBodyStream(strings.NewReader("ok"), -1)
+	appCtx.logAccess(ctx, time.Now())
+
+	record := <-appCtx.accessLog.ch
+	assert.Equal(t, 0, record.Bytes)
+
+	l := &accessLog{format: "combined"}
+	assert.Contains(t, string(l.formatRecord(record)), `" 200 - "`)
+}
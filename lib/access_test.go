@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAccessRules(t *testing.T) {
+	rules, err := parseAccessRules([]byte(`[
+		{"id": "office", "ips": ["10.0.0.0/8", "::1"], "action": "allow"},
+		{"id": "bot", "headers": {"User-Agent": "(?i)bot"}, "action": "challenge"},
+		{"id": "admin", "host": "^a\\.com$", "path": "^/admin", "methods": ["post"], "action": "deny"}
+	]`))
+	assert.Nil(t, err)
+
+	table := &accessTable{lock: &sync.RWMutex{}, rules: rules, secret: []byte("secret")}
+	blacklist := newBlacklistRules([]string{"", "http://b.com/"})
+
+	match := func(ip string, method string, uri string, ua string) string {
+		req := &fasthttp.Request{}
+		req.SetRequestURI(uri)
+		req.Header.SetMethod(method)
+		req.Header.Set("User-Agent", ua)
+
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+
+		rule := table.match(ctx, uri, blacklist)
+		if rule == nil {
+			return ""
+		}
+		return rule.ID
+	}
+
+	assert.Equal(t, "office", match("10.1.2.3", "POST", "http://a.com/admin", ""))
+	assert.Equal(t, "admin", match("1.1.1.1", "POST", "http://a.com/admin/x", ""))
+	assert.Equal(t, "", match("1.1.1.1", "GET", "http://a.com/admin", ""))
+	assert.Equal(t, "bot", match("1.1.1.1", "GET", "http://a.com/", "GoogleBot"))
+	assert.Equal(t, "blackList:http://b.com/", match("1.1.1.1", "GET", "http://b.com/c", ""))
+	assert.Equal(t, uint64(1), rules[1].Hits)
+
+	_, err = parseAccessRules([]byte(`[{"id": "a", "action": "block"}]`))
+	assert.NotNil(t, err)
+	_, err = parseAccessRules([]byte(`[{"id": "a", "ips": ["10.0.0"], "action": "deny"}]`))
+	assert.NotNil(t, err)
+}
+
+func TestCheckAccess(t *testing.T) {
+	rules, err := parseAccessRules([]byte(`[
+		{"id": "bot", "headers": {"User-Agent": "(?i)bot"}, "action": "challenge"},
+		{"id": "admin", "path": "^/admin", "action": "deny"}
+	]`))
+	assert.Nil(t, err)
+
+	conf := testConfig()
+	conf.Blacklist = "http://b.com/"
+	assert.Nil(t, conf.validate())
+
+	appCtx := &AppContext{
+		access:   &accessTable{lock: &sync.RWMutex{}, rules: rules, secret: []byte("secret")},
+		reqCount: &reqCount{chStatusCode: make(chan int, 10)},
+	}
+	appCtx.config.Store(conf)
+
+	check := func(uri string, ua string) bool {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.Set("User-Agent", ua)
+		return appCtx.checkAccess(ctx, uri)
+	}
+
+	// the marshal runs along with the requests
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		appCtx.access.marshal(conf.blacklist)
+		wg.Done()
+	}()
+
+	assert.True(t, check("http://a.com/", ""))
+	assert.False(t, check("http://a.com/admin", ""))
+	assert.False(t, check("http://a.com/", "bot"))
+	assert.False(t, check("http://b.com/c", ""))
+	wg.Wait()
+
+	// the denied and the challenged requests are counted
+	assert.Equal(t, 3, len(appCtx.reqCount.chStatusCode))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, statusForbiden, <-appCtx.reqCount.chStatusCode)
+	}
+
+	status := struct {
+		Rules     []accessRule `json:"rules"`
+		BlackList []accessRule `json:"blackList"`
+	}{}
+	assert.Nil(t, json.Unmarshal(appCtx.access.marshal(conf.blacklist), &status))
+	assert.Equal(t, uint64(1), status.Rules[1].Hits)
+	assert.Equal(t, "blackList:http://b.com/", status.BlackList[0].ID)
+	assert.Equal(t, uint64(1), status.BlackList[0].Hits)
+
+	appCtx.access.resetHits(conf.blacklist)
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&conf.blacklist[0].Hits))
+}
@@ -0,0 +1,448 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	ctrlKeyPrefix = "ctrlKey:"
+
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+
+	// the id of the key from the ctrlAuthKey option
+	bootstrapKeyID = "bootstrap"
+
+	// the max difference between the timestamp of a signed request and the local time
+	maxSignSkew = 5 * time.Minute
+
+	headerTimestamp = "X-Portal-Timestamp"
+	headerNonce     = "X-Portal-Nonce"
+)
+
+// the routes the read scope can access, the GET of the routes below without an action is read only too
+var readOnlyRoutes = map[string]bool{
+	"/status":              true,
+	"/metrics":             true,
+	"/warmup-status":       true,
+	"/restore-status":      true,
+	"/cache-list":          true,
+	"/cost-list":           true,
+	"/info":                true,
+	"/log-list":            true,
+	"/query-deps":          true,
+	"/boundary-quota-list": true,
+}
+
+var readOnlyGetRoutes = map[string]bool{
+	"/cache-policy": true,
+	"/config":       true,
+	"/cert":         true,
+	"/access-rules": true,
+	"/rate-limits":  true,
+}
+
+// ctrlKey is the credential of the control service.
+// The key can be used as a bearer token, or to sign the request with HMAC.
+type ctrlKey struct {
+	ID         string `json:"id"`
+	Secret     string `json:"secret,omitempty"`
+	Scope      string `json:"scope"`
+	CreateTime int64  `json:"createTime"`
+	RotateTime int64  `json:"rotateTime"`
+
+	// the secret before the rotation is still valid until the expire time
+	PrevSecret string `json:"prevSecret,omitempty"`
+	PrevExpire int64  `json:"prevExpire"`
+}
+
+// authStore holds the keys kept in db
+type authStore struct {
+	lock *sync.RWMutex
+	keys map[string]*ctrlKey
+
+	// the signatures already used, to the unix seconds they expire, so that a signed request can't be replayed
+	seen map[string]int64
+}
+
+func newAuthStore() *authStore {
+	store := &authStore{
+		lock: &sync.RWMutex{},
+		keys: map[string]*ctrlKey{},
+		seen: map[string]int64{},
+	}
+
+	iter := db.NewIterator(util.BytesPrefix([]byte(ctrlKeyPrefix)), nil)
+	for iter.Next() {
+		key := &ctrlKey{}
+		if json.Unmarshal(iter.Value(), key) == nil {
+			store.keys[key.ID] = key
+		}
+	}
+	iter.Release()
+
+	return store
+}
+
+// the secrets must not be generated without enough entropy
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.New("random key error: " + err.Error())
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (store *authStore) save(key *ctrlKey) error {
+	data, _ := json.Marshal(key)
+	return db.Put([]byte(ctrlKeyPrefix+key.ID), data, nil)
+}
+
+func (store *authStore) create(scope string) (*ctrlKey, error) {
+	if scope != scopeRead && scope != scopeAdmin {
+		return nil, errors.New("scope should be read or admin")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano() / 1000 / 1000
+	key := &ctrlKey{
+		ID:         id,
+		Secret:     secret,
+		Scope:      scope,
+		CreateTime: now,
+		RotateTime: now,
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	err = store.save(key)
+	if err != nil {
+		return nil, err
+	}
+
+	store.keys[key.ID] = key
+	return key, nil
+}
+
+// replace the secret of the key, the old one is still valid within the grace period
+func (store *authStore) rotate(id string, grace time.Duration) (*ctrlKey, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	prev, has := store.keys[id]
+	if !has {
+		return nil, errors.New("key not found: " + id)
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	key := *prev
+	key.PrevSecret = prev.Secret
+	key.PrevExpire = now.Add(grace).UnixNano() / 1000 / 1000
+	key.Secret = secret
+	key.RotateTime = now.UnixNano() / 1000 / 1000
+
+	err = store.save(&key)
+	if err != nil {
+		return nil, err
+	}
+
+	store.keys[id] = &key
+	return &key, nil
+}
+
+func (store *authStore) del(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	err := db.Delete([]byte(ctrlKeyPrefix+id), nil)
+	if err != nil {
+		return err
+	}
+
+	delete(store.keys, id)
+	return nil
+}
+
+// the keys without the secrets
+func (store *authStore) list() []*ctrlKey {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	list := []*ctrlKey{}
+	for _, key := range store.keys {
+		k := *key
+		k.Secret = ""
+		k.PrevSecret = ""
+		list = append(list, &k)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreateTime < list[j].CreateTime
+	})
+
+	return list
+}
+
+func (store *authStore) count() int {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return len(store.keys)
+}
+
+// the secrets of the key which are valid now
+func (key *ctrlKey) secrets(now time.Time) []string {
+	list := []string{key.Secret}
+	if key.PrevSecret != "" && now.UnixNano()/1000/1000 < key.PrevExpire {
+		list = append(list, key.PrevSecret)
+	}
+	return list
+}
+
+// the bootstrap key is from the config, it's not kept in db
+func (store *authStore) get(id string, bootstrap string) *ctrlKey {
+	if id == bootstrapKeyID {
+		if bootstrap == "" {
+			return nil
+		}
+		return &ctrlKey{ID: bootstrapKeyID, Secret: bootstrap, Scope: scopeAdmin}
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.keys[id]
+}
+
+func (store *authStore) findByToken(token string, bootstrap string, now time.Time) *ctrlKey {
+	if bootstrap != "" && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrap)) == 1 {
+		return store.get(bootstrapKeyID, bootstrap)
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, key := range store.keys {
+		for _, secret := range key.secrets(now) {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+				return key
+			}
+		}
+	}
+
+	return nil
+}
+
+// the string to sign is the method, the request uri, the timestamp, the nonce and the sha256 of the body, joined by "\n"
+func signCtrlRequest(secret string, method string, uri string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify the Authorization header, such as "Bearer {secret}" or "HMAC {id}:{signature}"
+func (store *authStore) verify(ctx *fasthttp.RequestCtx, bootstrap string, now time.Time) (*ctrlKey, error) {
+	auth := string(ctx.Request.Header.Peek("Authorization"))
+
+	switch {
+	case auth == "":
+		return nil, errors.New("missing credentials")
+
+	case strings.HasPrefix(auth, "Bearer "):
+		key := store.findByToken(strings.TrimPrefix(auth, "Bearer "), bootstrap, now)
+		if key == nil {
+			return nil, errors.New("invalid token")
+		}
+		return key, nil
+
+	case strings.HasPrefix(auth, "HMAC "):
+		parts := strings.SplitN(strings.TrimPrefix(auth, "HMAC "), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("malformed signature")
+		}
+
+		timestamp := string(ctx.Request.Header.Peek(headerTimestamp))
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || math.Abs(now.Sub(time.Unix(sec, 0)).Seconds()) > maxSignSkew.Seconds() {
+			return nil, errors.New("invalid timestamp")
+		}
+
+		nonce := string(ctx.Request.Header.Peek(headerNonce))
+		if nonce == "" {
+			return nil, errors.New("missing nonce")
+		}
+
+		key := store.get(parts[0], bootstrap)
+		if key == nil {
+			return nil, errors.New("unknown key: " + parts[0])
+		}
+
+		method := string(ctx.Method())
+		uri := string(ctx.RequestURI())
+		for _, secret := range key.secrets(now) {
+			expected := signCtrlRequest(secret, method, uri, timestamp, nonce, ctx.PostBody())
+			if hmac.Equal([]byte(parts[1]), []byte(expected)) {
+				if !store.remember(key.ID+":"+parts[1], sec+int64(maxSignSkew/time.Second), now) {
+					return nil, errors.New("replayed signature")
+				}
+				return key, nil
+			}
+		}
+		return nil, errors.New("invalid signature")
+	}
+
+	return nil, errors.New("unsupported authorization")
+}
+
+// Returns false if the signature is already used. It's kept until the expire time,
+// after that its timestamp is out of the maxSignSkew.
+func (store *authStore) remember(signature string, expire int64, now time.Time) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for sig, t := range store.seen {
+		if t < now.Unix() {
+			delete(store.seen, sig)
+		}
+	}
+
+	if _, has := store.seen[signature]; has {
+		return false
+	}
+
+	store.seen[signature] = expire
+	return true
+}
+
+// the scope the control request requires
+func ctrlScope(ctx *fasthttp.RequestCtx) string {
+	path := string(ctx.Path())
+
+	if readOnlyRoutes[path] {
+		return scopeRead
+	}
+
+	if readOnlyGetRoutes[path] && !ctx.IsPost() && len(ctx.QueryArgs().Peek("action")) == 0 {
+		return scopeRead
+	}
+
+	return scopeAdmin
+}
+
+// Returns false if the control request is rejected.
+// The auth is enabled when the ctrlAuthKey is set or there's any key in db.
+func (appCtx *AppContext) authorize(ctx *fasthttp.RequestCtx) bool {
+	bootstrap := appCtx.conf().CtrlAuthKey
+
+	if bootstrap == "" && appCtx.auth.count() == 0 {
+		return true
+	}
+
+	key, err := appCtx.auth.verify(ctx, bootstrap, time.Now())
+
+	if err == nil && key.Scope != scopeAdmin && ctrlScope(ctx) == scopeAdmin {
+		err = errors.New("key " + key.ID + " is read only")
+		appCtx.rejectCtrl(ctx, http.StatusForbidden, err)
+		return false
+	}
+
+	if err != nil {
+		ctx.Response.Header.Set("WWW-Authenticate", `Bearer realm="portal"`)
+		appCtx.rejectCtrl(ctx, http.StatusUnauthorized, err)
+		return false
+	}
+
+	return true
+}
+
+func (appCtx *AppContext) rejectCtrl(ctx *fasthttp.RequestCtx, status int, err error) {
+	appCtx.log.http(
+		string(ctx.RequestURI()),
+		status,
+		fmt.Sprintf("control auth rejected from %s: %s", ctx.RemoteIP(), err.Error()),
+	)
+
+	ctx.Error(err.Error(), status)
+}
+
+// curl -H 'Authorization: Bearer {secret}' 127.0.0.1:7071/keys
+// curl -H 'Authorization: Bearer {secret}' 127.0.0.1:7071/keys?action=create&scope=read
+// curl -H 'Authorization: Bearer {secret}' 127.0.0.1:7071/keys?action=rotate&id={id}&grace=3600
+// curl -H 'Authorization: Bearer {secret}' 127.0.0.1:7071/keys?action=delete&id={id}
+func (appCtx *AppContext) handleKeys(ctx *fasthttp.RequestCtx) {
+	id := string(ctx.QueryArgs().Peek("id"))
+
+	var key *ctrlKey
+	var err error
+
+	switch string(ctx.QueryArgs().Peek("action")) {
+	case "create":
+		key, err = appCtx.auth.create(string(ctx.QueryArgs().Peek("scope")))
+
+	case "rotate":
+		grace, _ := ctx.QueryArgs().GetUint("grace")
+		key, err = appCtx.auth.rotate(id, time.Duration(grace)*time.Second)
+
+	case "delete":
+		err = appCtx.auth.del(id)
+
+	case "":
+
+	default:
+		err = errBadAction
+	}
+
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	var data []byte
+	if key != nil {
+		// the only chance to get the new secret
+		k := *key
+		k.PrevSecret = ""
+		data, _ = json.Marshal(&k)
+	} else {
+		data, _ = json.Marshal(appCtx.auth.list())
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(data)
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAuthVerify(t *testing.T) {
+	now := time.Now()
+	store := &authStore{
+		lock: &sync.RWMutex{},
+		keys: map[string]*ctrlKey{
+			"a": {ID: "a", Secret: "new", Scope: scopeRead, PrevSecret: "old", PrevExpire: now.Add(time.Minute).UnixNano() / 1000 / 1000},
+			"b": {ID: "b", Secret: "b", Scope: scopeAdmin, PrevSecret: "expired", PrevExpire: now.Add(-time.Minute).UnixNano() / 1000 / 1000},
+		},
+		seen: map[string]int64{},
+	}
+
+	verifyNonce := func(auth string, timestamp string, nonce string) (*ctrlKey, error) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/purge?eventId=1")
+		ctx.Request.Header.Set("Authorization", auth)
+		ctx.Request.Header.Set(headerTimestamp, timestamp)
+		ctx.Request.Header.Set(headerNonce, nonce)
+		return store.verify(ctx, "root", now)
+	}
+	verify := func(auth string, timestamp string) (*ctrlKey, error) {
+		return verifyNonce(auth, timestamp, "n1")
+	}
+
+	key, _ := verify("Bearer new", "")
+	assert.Equal(t, "a", key.ID)
+	key, _ = verify("Bearer old", "")
+	assert.Equal(t, "a", key.ID)
+	key, _ = verify("Bearer root", "")
+	assert.Equal(t, scopeAdmin, key.Scope)
+
+	_, err := verify("Bearer expired", "")
+	assert.NotNil(t, err)
+	_, err = verify("", "")
+	assert.NotNil(t, err)
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sign := signCtrlRequest("b", "GET", "/purge?eventId=1", ts, "n1", nil)
+
+	key, _ = verify("HMAC b:"+sign, ts)
+	assert.Equal(t, "b", key.ID)
+
+	// the same signed request can't be replayed
+	_, err = verify("HMAC b:"+sign, ts)
+	assert.EqualError(t, err, "replayed signature")
+
+	// the same request with a new nonce
+	key, _ = verifyNonce("HMAC b:"+signCtrlRequest("b", "GET", "/purge?eventId=1", ts, "n2", nil), ts, "n2")
+	assert.Equal(t, "b", key.ID)
+
+	_, err = verifyNonce("HMAC b:"+signCtrlRequest("b", "GET", "/purge?eventId=1", ts, "", nil), ts, "")
+	assert.EqualError(t, err, "missing nonce")
+
+	_, err = verify("HMAC a:"+sign, ts)
+	assert.NotNil(t, err)
+
+	stale := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+	_, err = verify("HMAC b:"+signCtrlRequest("b", "GET", "/purge?eventId=1", stale, "n1", nil), stale)
+	assert.NotNil(t, err)
+}
+
+func TestAuthRemember(t *testing.T) {
+	now := time.Now()
+	store := &authStore{lock: &sync.RWMutex{}, seen: map[string]int64{}}
+
+	assert.True(t, store.remember("a:1", now.Unix()+1, now))
+	assert.False(t, store.remember("a:1", now.Unix()+1, now))
+
+	// the expired ones are dropped
+	later := now.Add(2 * time.Second)
+	assert.True(t, store.remember("a:2", later.Unix()+1, later))
+	assert.Len(t, store.seen, 1)
+}
+
+func TestCtrlScope(t *testing.T) {
+	scope := func(method string, uri string) string {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		return ctrlScope(ctx)
+	}
+
+	assert.Equal(t, scopeRead, scope("GET", "/status"))
+	assert.Equal(t, scopeRead, scope("GET", "/config"))
+	assert.Equal(t, scopeAdmin, scope("POST", "/config"))
+	assert.Equal(t, scopeAdmin, scope("GET", "/config?action=reload"))
+	assert.Equal(t, scopeAdmin, scope("POST", "/test-query"))
+	assert.Equal(t, scopeAdmin, scope("GET", "/keys"))
+}
@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a backend is marked unhealthy after this many continuous failures,
+// a successful probe or request brings it back
+const backendMaxFailures = 3
+
+type backend struct {
+	addr   string
+	weight int
+
+	healthy      int32
+	failures     int32
+	requestCount uint64
+	errorCount   uint64
+	latency      int64 // the moving average of the request latency in nanoseconds
+	probeLatency int64
+	probeTime    int64
+	fetchLatency *histogram
+}
+
+type backendPool struct {
+	lock       *sync.RWMutex // guards the list and the healthPath, they can be reset by the config reload
+	list       []*backend
+	healthPath string
+	probeSpan  time.Duration
+	client     *http.Client
+}
+
+// the addrs is separated by comma, such as "10.0.0.1:7000@3,10.0.0.2:7000",
+// the number after "@" is the weight of the backend, default is 1
+func parseBackends(addrs string) ([]*backend, error) {
+	list := []*backend{}
+
+	for _, item := range strings.Split(addrs, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		weight := 1
+		if index := strings.LastIndexByte(item, '@'); index > -1 {
+			w, err := strconv.Atoi(item[index+1:])
+			if err != nil || w < 1 {
+				return nil, errors.New("invalid backend weight: " + item)
+			}
+			weight = w
+			item = item[:index]
+		}
+
+		list = append(list, &backend{
+			addr:         item,
+			weight:       weight,
+			healthy:      1,
+			fetchLatency: newHistogram(),
+		})
+	}
+
+	if len(list) == 0 {
+		return nil, errors.New("no backend file service address")
+	}
+
+	return list, nil
+}
+
+func newBackendPool(addrs string, healthPath string, probeSpan time.Duration) *backendPool {
+	list, err := parseBackends(addrs)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := &backendPool{
+		lock:       &sync.RWMutex{},
+		list:       list,
+		healthPath: healthPath,
+		probeSpan:  probeSpan,
+		client: &http.Client{
+			Timeout: 3 * time.Second,
+		},
+	}
+
+	if probeSpan > 0 {
+		go pool.prober()
+	}
+
+	return pool
+}
+
+// replace the backends, the states of the unchanged ones are kept
+func (pool *backendPool) setList(list []*backend, healthPath string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for i, b := range list {
+		for _, old := range pool.list {
+			if old.addr == b.addr && old.weight == b.weight {
+				list[i] = old
+			}
+		}
+	}
+
+	pool.list = list
+	pool.healthPath = healthPath
+}
+
+func (pool *backendPool) getList() []*backend {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.list
+}
+
+func (pool *backendPool) prober() {
+	for {
+		time.Sleep(pool.probeSpan)
+
+		for _, b := range pool.getList() {
+			go pool.probe(b)
+		}
+	}
+}
+
+func (pool *backendPool) probe(b *backend) {
+	startTime := time.Now()
+
+	pool.lock.RLock()
+	healthPath := pool.healthPath
+	pool.lock.RUnlock()
+
+	res, err := pool.client.Get((&url.URL{
+		Scheme: "http",
+		Host:   b.addr,
+		Path:   healthPath,
+	}).String())
+
+	atomic.StoreInt64(&b.probeLatency, int64(time.Since(startTime)))
+	atomic.StoreInt64(&b.probeTime, startTime.UnixNano())
+
+	if err == nil {
+		res.Body.Close()
+	}
+
+	if err != nil || res.StatusCode >= 500 {
+		b.fail()
+		return
+	}
+
+	b.succeed()
+}
+
+// the backend is marked down after the continuous failures of the requests or the probes
+func (b *backend) fail() {
+	if atomic.AddInt32(&b.failures, 1) >= backendMaxFailures &&
+		atomic.SwapInt32(&b.healthy, 0) == 1 {
+		fmt.Fprintln(os.Stderr, "backend down:", b.addr)
+	}
+}
+
+func (b *backend) succeed() {
+	atomic.StoreInt32(&b.failures, 0)
+	if atomic.SwapInt32(&b.healthy, 1) == 0 {
+		fmt.Println("backend up:", b.addr)
+	}
+}
+
+func (b *backend) done(latency time.Duration, failed bool) {
+	atomic.AddUint64(&b.requestCount, 1)
+	b.fetchLatency.observe(latency)
+
+	old := atomic.LoadInt64(&b.latency)
+	if old == 0 {
+		atomic.StoreInt64(&b.latency, int64(latency))
+	} else {
+		atomic.StoreInt64(&b.latency, old-old/8+int64(latency)/8)
+	}
+
+	if !failed {
+		b.succeed()
+		return
+	}
+
+	atomic.AddUint64(&b.errorCount, 1)
+	b.fail()
+}
+
+// the weighted random one of the healthy backends goes first,
+// then the rest healthy ones, the unhealthy ones are the last resort
+func (pool *backendPool) candidates() []*backend {
+	healthy := []*backend{}
+	unhealthy := []*backend{}
+	total := 0
+
+	for _, b := range pool.getList() {
+		if atomic.LoadInt32(&b.healthy) == 1 {
+			healthy = append(healthy, b)
+			total += b.weight
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	if len(healthy) > 1 {
+		randLock.Lock()
+		n := randNum.Intn(total)
+		randLock.Unlock()
+
+		for i, b := range healthy {
+			n -= b.weight
+			if n < 0 {
+				healthy[0], healthy[i] = healthy[i], healthy[0]
+				break
+			}
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// try the backends one by one until one of them responds without a server error,
+// the last server error is returned if all of them failed
+func (pool *backendPool) do(fn func(addr string) (*http.Response, error)) (*http.Response, error) {
+	var last *http.Response
+	var err error
+
+	for _, b := range pool.candidates() {
+		startTime := time.Now()
+
+		res, resErr := fn(b.addr)
+
+		b.done(time.Since(startTime), resErr != nil || res.StatusCode >= 500)
+
+		if resErr != nil {
+			err = resErr
+			fmt.Fprintln(os.Stderr, "backend "+b.addr+" error:\n"+err.Error())
+			continue
+		}
+
+		if res.StatusCode < 500 {
+			if last != nil {
+				last.Body.Close()
+			}
+			return res, nil
+		}
+
+		fmt.Fprintln(os.Stderr, "backend "+b.addr+" status code:", res.StatusCode)
+		if last != nil {
+			last.Body.Close()
+		}
+		last = res
+	}
+
+	if last != nil {
+		return last, nil
+	}
+
+	if err == nil {
+		err = errors.New("no backend available")
+	}
+
+	return nil, err
+}
+
+// the header is optional
+func (pool *backendPool) get(path string, query string, header http.Header) (*http.Response, error) {
+	return pool.do(func(addr string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", (&url.URL{
+			Scheme:   "http",
+			Host:     addr,
+			Path:     path,
+			RawQuery: query,
+		}).String(), nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		return http.DefaultClient.Do(req)
+	})
+}
+
+func (pool *backendPool) post(path string, body string) (*http.Response, error) {
+	return pool.do(func(addr string) (*http.Response, error) {
+		return http.Post((&url.URL{
+			Scheme: "http",
+			Host:   addr,
+			Path:   path,
+		}).String(), "", strings.NewReader(body))
+	})
+}
+
+func (pool *backendPool) status() []map[string]interface{} {
+	list := []map[string]interface{}{}
+
+	for _, b := range pool.getList() {
+		list = append(list, map[string]interface{}{
+			"addr":         b.addr,
+			"weight":       b.weight,
+			"healthy":      atomic.LoadInt32(&b.healthy) == 1,
+			"failures":     atomic.LoadInt32(&b.failures),
+			"requestCount": atomic.LoadUint64(&b.requestCount),
+			"errorCount":   atomic.LoadUint64(&b.errorCount),
+			"latency":      float64(atomic.LoadInt64(&b.latency)) / 1e6,
+			"probeLatency": float64(atomic.LoadInt64(&b.probeLatency)) / 1e6,
+			"probeTime":    atomic.LoadInt64(&b.probeTime) / 1000 / 1000,
+		})
+	}
+
+	return list
+}
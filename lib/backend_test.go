@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendPoolCandidates(t *testing.T) {
+	pool := newBackendPool("a:1@3, b:2,c:3", "/", 0)
+
+	assert.Equal(t, 3, len(pool.list))
+	assert.Equal(t, "a:1", pool.list[0].addr)
+	assert.Equal(t, 3, pool.list[0].weight)
+	assert.Equal(t, 1, pool.list[1].weight)
+
+	for i := 0; i < backendMaxFailures; i++ {
+		pool.list[1].done(0, true)
+	}
+
+	list := pool.candidates()
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, "b:2", list[2].addr)
+
+	pool.list[1].done(0, false)
+	assert.Equal(t, int32(1), pool.list[1].healthy)
+}
+
+func TestBackendPoolFailover(t *testing.T) {
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer failed.Close()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+
+	pool := newBackendPool(failed.Listener.Addr().String()+","+ok.Listener.Addr().String(), "/", 0)
+
+	// the unhealthy one is the last resort
+	pool.list[1].healthy = 0
+
+	res, err := pool.get("/api/file", "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, uint64(1), pool.list[0].errorCount)
+	assert.Equal(t, int32(1), pool.list[1].healthy)
+
+	ok.Close()
+	res, err = pool.get("/api/file", "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, res.StatusCode)
+	res.Body.Close()
+
+	for i := 0; i < backendMaxFailures; i++ {
+		pool.probe(pool.list[0])
+	}
+	assert.Equal(t, int32(0), pool.list[0].healthy)
+}
@@ -1,10 +1,17 @@
 package lib
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/valyala/fasthttp"
+	"github.com/ysmood/portal/lib/utils"
 	"github.com/ysmood/umi"
 )
 
@@ -216,3 +223,75 @@ func BenchmarkGispComplex(b *testing.B) {
 		}
 	}
 }
+
+// the app context with a backend which takes 1ms to respond
+func newMissBenchContext() (*AppContext, func()) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Header().Set("Portm-Type", "Text")
+		w.Write([]byte("ok"))
+	}))
+
+	rc := &reqCount{chStatusCode: make(chan int, 100)}
+	go func() {
+		for range rc.chStatusCode {
+		}
+	}()
+
+	appCtx := &AppContext{
+		cache:        umi.New(nil),
+		fileStore:    newFileStore(0),
+		backends:     newBackendPool(strings.TrimPrefix(backend.URL, "http://"), "/", 0),
+		reqCount:     rc,
+		fetching:     utils.NewFlightGroup(),
+		overload:     300,
+		runtimeCache: newRuntimeCache(),
+	}
+	appCtx.config.Store(&Config{
+		cacheTTL:    time.Minute,
+		maxCacheTTL: time.Minute,
+		negativeTTL: time.Minute,
+	})
+
+	return appCtx, backend.Close
+}
+
+func BenchmarkGetFileMiss(b *testing.B) {
+	appCtx, done := newMissBenchContext()
+	defer done()
+
+	count := uint64(0)
+
+	b.ResetTimer()
+
+	// every uri is a miss, they don't block each other
+	b.SetParallelism(8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&count, 1)
+			appCtx.getFile("http://test.com/" + strconv.FormatUint(i, 10))
+		}
+	})
+}
+
+// the baseline of the BenchmarkGetFileMiss, the misses are serialized by a global lock
+// the same as the old workingLock
+func BenchmarkGetFileMissGlobalLock(b *testing.B) {
+	appCtx, done := newMissBenchContext()
+	defer done()
+
+	count := uint64(0)
+	workingLock := &sync.Mutex{}
+
+	b.ResetTimer()
+
+	b.SetParallelism(8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&count, 1)
+			workingLock.Lock()
+			appCtx.getFile("http://test.com/" + strconv.FormatUint(i, 10))
+			workingLock.Unlock()
+		}
+	})
+}
@@ -0,0 +1,288 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const cachePolicyKey = "cachePolicy"
+
+// the freshness headers for the clients and the CDN
+type cachePolicy struct {
+	CacheControl     string `json:"cacheControl,omitempty"`
+	Expires          int64  `json:"expires,omitempty"` // seconds after the response time
+	SurrogateControl string `json:"surrogateControl,omitempty"`
+}
+
+type cachePolicyRule struct {
+	Host string `json:"host"` // regexp of the host, empty matches any
+	Path string `json:"path"` // regexp of the path, empty matches any
+	Type string `json:"type"` // name of the FileType, such as "Binary", empty matches any
+	cachePolicy
+
+	hostReg *regexp.Regexp
+	pathReg *regexp.Regexp
+}
+
+// cachePolicyTable maps the files to the cache policies, the first matched rule wins.
+// The rules edited by the control service are kept in db, they take precedence over the config file.
+type cachePolicyTable struct {
+	lock   *sync.RWMutex
+	rules  []*cachePolicyRule
+	path   string // the config file
+	edited bool   // the rules are edited by the control service
+}
+
+func newCachePolicyTable(path string) *cachePolicyTable {
+	table := &cachePolicyTable{
+		lock:  &sync.RWMutex{},
+		rules: []*cachePolicyRule{},
+		path:  path,
+	}
+
+	data, err := db.Get([]byte(cachePolicyKey), nil)
+	if err == nil {
+		table.edited = true
+	} else {
+		data, err = table.readConfig()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = table.load(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+func (table *cachePolicyTable) readConfig() ([]byte, error) {
+	table.lock.RLock()
+	path := table.path
+	table.lock.RUnlock()
+
+	if path == "" {
+		return []byte("[]"), nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+func parseCachePolicyRules(data []byte) ([]*cachePolicyRule, error) {
+	rules := []*cachePolicyRule{}
+
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if rule == nil {
+			return nil, errors.New("cache policy rule is null")
+		}
+
+		rule.hostReg, err = regexp.Compile(rule.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.pathReg, err = regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+func (table *cachePolicyTable) load(data []byte) error {
+	rules, err := parseCachePolicyRules(data)
+	if err != nil {
+		return err
+	}
+
+	table.lock.Lock()
+	table.rules = rules
+	table.lock.Unlock()
+
+	return nil
+}
+
+// replace the rules and persist them
+func (table *cachePolicyTable) set(data []byte) error {
+	err := table.load(data)
+	if err != nil {
+		return err
+	}
+
+	table.lock.Lock()
+	table.edited = true
+	table.lock.Unlock()
+
+	return db.Put([]byte(cachePolicyKey), data, nil)
+}
+
+// switch to the rules of another config file, the edited rules are kept
+func (table *cachePolicyTable) use(path string, rules []*cachePolicyRule) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	table.path = path
+	if !table.edited {
+		table.rules = rules
+	}
+}
+
+// drop the edited rules and load the config file again
+func (table *cachePolicyTable) reset() error {
+	data, err := table.readConfig()
+	if err != nil {
+		return err
+	}
+
+	err = table.load(data)
+	if err != nil {
+		return err
+	}
+
+	table.lock.Lock()
+	table.edited = false
+	table.lock.Unlock()
+
+	return db.Delete([]byte(cachePolicyKey), nil)
+}
+
+func (table *cachePolicyTable) match(host string, path string, fileType FileType) *cachePolicy {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	for _, rule := range table.rules {
+		if rule.Type != "" && rule.Type != fileType.String() {
+			continue
+		}
+		if rule.hostReg.MatchString(host) && rule.pathReg.MatchString(path) {
+			return &rule.cachePolicy
+		}
+	}
+
+	return nil
+}
+
+func (table *cachePolicyTable) marshal() []byte {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	data, _ := json.Marshal(table.rules)
+	return data
+}
+
+// the non-empty fields of the override take precedence
+func (policy cachePolicy) merge(override *cachePolicy) cachePolicy {
+	if override == nil {
+		return policy
+	}
+
+	if override.CacheControl != "" {
+		policy.CacheControl = override.CacheControl
+	}
+	if override.Expires != 0 {
+		policy.Expires = override.Expires
+	}
+	if override.SurrogateControl != "" {
+		policy.SurrogateControl = override.SurrogateControl
+	}
+
+	return policy
+}
+
+// the policy of the file itself, from the Portm-Cache-Control, Portm-Expires and Portm-Surrogate-Control headers
+func parseFilePolicy(policy *cachePolicy, key string, value string) *cachePolicy {
+	if policy == nil {
+		policy = &cachePolicy{}
+	}
+
+	switch key {
+	case "Portm-Cache-Control":
+		policy.CacheControl = value
+	case "Portm-Expires":
+		policy.Expires, _ = strconv.ParseInt(value, 10, 64)
+	case "Portm-Surrogate-Control":
+		policy.SurrogateControl = value
+	}
+
+	return policy
+}
+
+// Set the cache headers of the file, the gisp could overwrite them with setResHeader.
+// Returns the headers that are set.
+func (appCtx *AppContext) setCachePolicy(ctx *fasthttp.RequestCtx, file *File) map[string]string {
+	var policy cachePolicy
+
+	if matched := appCtx.cachePolicy.match(string(ctx.Host()), string(ctx.Path()), file.Type); matched != nil {
+		policy = *matched
+	}
+
+	policy = policy.merge(file.CachePolicy)
+
+	headers := map[string]string{}
+	if policy.CacheControl != "" {
+		headers["Cache-Control"] = policy.CacheControl
+	}
+	if policy.Expires != 0 {
+		headers["Expires"] = time.Now().Add(time.Duration(policy.Expires) * time.Second).UTC().Format(http.TimeFormat)
+	}
+	if policy.SurrogateControl != "" {
+		headers["Surrogate-Control"] = policy.SurrogateControl
+	}
+
+	for k, v := range headers {
+		ctx.Response.Header.Set(k, v)
+	}
+
+	return headers
+}
+
+// The cache headers are only for the 2xx and 304 responses, so that the errors won't be cached by the CDN.
+// The ones overwritten by the gisp are kept.
+func clearCachePolicy(ctx *fasthttp.RequestCtx, headers map[string]string) {
+	code := ctx.Response.StatusCode()
+	if code >= 200 && code < 300 || code == statusNotModified {
+		return
+	}
+
+	for k, v := range headers {
+		if string(ctx.Response.Header.Peek(k)) == v {
+			ctx.Response.Header.Del(k)
+		}
+	}
+}
+
+// curl 127.0.0.1:7071/cache-policy
+// curl -d '[{"host": "^a.com$", "path": "\\.js$", "type": "Binary", "cacheControl": "max-age=3600"}]' 127.0.0.1:7071/cache-policy
+// curl 127.0.0.1:7071/cache-policy?action=reset
+func (appCtx *AppContext) handleCachePolicy(ctx *fasthttp.RequestCtx) {
+	var err error
+
+	if ctx.IsPost() {
+		err = appCtx.cachePolicy.set(ctx.PostBody())
+	} else if string(ctx.QueryArgs().Peek("action")) == "reset" {
+		err = appCtx.cachePolicy.reset()
+	}
+
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(appCtx.cachePolicy.marshal())
+}
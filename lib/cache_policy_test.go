@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestCachePolicyMatch(t *testing.T) {
+	rules, err := parseCachePolicyRules([]byte(`[
+		{"host": "^a\\.com$", "path": "\\.js$", "type": "Binary", "cacheControl": "max-age=3600"},
+		{"path": "^/api/", "cacheControl": "no-cache", "surrogateControl": "max-age=60"},
+		{"cacheControl": "max-age=60", "expires": 60}
+	]`))
+	assert.Nil(t, err)
+
+	table := &cachePolicyTable{lock: &sync.RWMutex{}, rules: rules}
+
+	assert.Equal(t, "max-age=3600", table.match("a.com", "/b.js", fileTypeBinary).CacheControl)
+	assert.Equal(t, "max-age=60", table.match("a.com", "/b.js", fileTypeText).CacheControl)
+	assert.Equal(t, "max-age=60", table.match("a.com", "/api/b", fileTypeJSON).SurrogateControl)
+
+	policy := table.match("b.com", "/", fileTypeJSON).merge(&cachePolicy{CacheControl: "private"})
+	assert.Equal(t, cachePolicy{CacheControl: "private", Expires: 60}, policy)
+
+	_, err = parseCachePolicyRules([]byte(`[{"path": "("}]`))
+	assert.NotNil(t, err)
+}
+
+func TestCachePolicyStatus(t *testing.T) {
+	var failing int32
+	appCtx, clean := testBackendContext(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Portm-Type", "Text")
+		w.Header().Set("Portm-Modify-Time", "2018-01-02T03:04:05Z")
+		w.Write([]byte("ok"))
+	})
+	defer clean()
+
+	rules, _ := parseCachePolicyRules([]byte(`[{"cacheControl": "max-age=60", "surrogateControl": "max-age=60"}]`))
+	appCtx.cachePolicy = &cachePolicyTable{lock: &sync.RWMutex{}, rules: rules}
+
+	handle := func(uri string, header map[string]string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("http://a.com/b")
+		for k, v := range header {
+			ctx.Request.Header.Set(k, v)
+		}
+		appCtx.handleFile(uri, ctx)
+		return ctx
+	}
+
+	ctx := handle("a.com/b", nil)
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "max-age=60", string(ctx.Response.Header.Peek("Cache-Control")))
+
+	ctx = handle("a.com/b", map[string]string{"If-Modified-Since": "Tue, 02 Jan 2018 03:04:05 GMT"})
+	assert.Equal(t, statusNotModified, ctx.Response.StatusCode())
+
+	ctx = handle("a.com/b", map[string]string{"If-Unmodified-Since": "Mon, 01 Jan 2018 00:00:00 GMT"})
+	assert.Equal(t, statusPreconditionFail, ctx.Response.StatusCode())
+	assert.Nil(t, ctx.Response.Header.Peek("Cache-Control"))
+	assert.Nil(t, ctx.Response.Header.Peek("Surrogate-Control"))
+
+	// the error placeholder
+	atomic.StoreInt32(&failing, 1)
+	ctx = handle("a.com/c", nil)
+	assert.Equal(t, "file service error", string(ctx.Response.Body()))
+	assert.Nil(t, ctx.Response.Header.Peek("Cache-Control"))
+}
+
+func TestClearCachePolicy(t *testing.T) {
+	headers := map[string]string{"Cache-Control": "max-age=60", "Surrogate-Control": "max-age=60"}
+
+	ctx := &fasthttp.RequestCtx{}
+	for k, v := range headers {
+		ctx.Response.Header.Set(k, v)
+	}
+	// overwritten by the gisp
+	ctx.Response.Header.Set("Surrogate-Control", "no-store")
+	ctx.SetStatusCode(statusTooManyRequests)
+
+	clearCachePolicy(ctx, headers)
+	assert.Nil(t, ctx.Response.Header.Peek("Cache-Control"))
+	assert.Equal(t, "no-store", string(ctx.Response.Header.Peek("Surrogate-Control")))
+}
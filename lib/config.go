@@ -0,0 +1,553 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"os/user"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/portal/lib/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the settings of the AppContext, the json and yaml keys are the same as the flag names.
+// The precedence is: config file < env < flag.
+type Config struct {
+	Addr              string `json:"addr"`
+	CtrlServiceAddr   string `json:"fileAddr"` // the flag names of the two addresses are swapped, kept for compatibility
+	FileServiceAddr   string `json:"ctrlAddr"`
+	BackendHealthPath string `json:"backendHealthPath"`
+	BackendProbeSpan  int    `json:"backendProbeSpan"`
+	CacheSize         int    `json:"cacheSize"`
+	GlobCacheSize     int    `json:"globCacheSize"`
+	DbPath            string `json:"dbPath"`
+	Overload          int    `json:"overload"`
+	Blacklist         string `json:"blackList"`
+	PersistMaxAge     int    `json:"persistMaxAge"`
+	ServeStale        bool   `json:"serveStale"`
+	MaxStale          int    `json:"maxStale"`
+	CacheTTL          int    `json:"cacheTTL"`
+	NegativeTTL       int    `json:"negativeTTL"`
+	MaxCacheTTL       int    `json:"maxCacheTTL"`
+	SubscribePath     string `json:"subscribePath"`
+	Peers             string `json:"peers"`
+	Zstd              bool   `json:"zstd"`
+	MaxCacheableSize  int    `json:"maxCacheableSize"`
+	DiskCacheDir      string `json:"diskCacheDir"`
+	MaxVariants       int    `json:"maxVariants"`
+	CachePolicy       string `json:"cachePolicy"`
+	TLSAddr           string `json:"tlsAddr"`
+	CertDir           string `json:"certDir"`
+	CertReloadSpan    int    `json:"certReloadSpan"`
+	HTTPSRedirect     string `json:"httpsRedirect"`
+	HSTS              string `json:"hsts"`
+	HSTSMaxAge        int    `json:"hstsMaxAge"`
+	DrainTimeout      int    `json:"drainTimeout"`
+	MaxRequestBody    int    `json:"maxRequestBody"`
+	MaxFnRunCount     int    `json:"maxFnRunCount"`
+	GzipMinSize       int    `json:"gzipMinSize"`
+	BrotliMinSize     int    `json:"brotliMinSize"`
+	ZstdMinSize       int    `json:"zstdMinSize"`
+	HTTPTimeout       int    `json:"httpTimeout"`
+	CtrlAuthKey       string `json:"ctrlAuthKey"`
+
+	AccessLog           string `json:"accessLog"`
+	AccessLogFormat     string `json:"accessLogFormat"`
+	AccessLogMaxSize    int    `json:"accessLogMaxSize"`
+	AccessLogRotateSpan int    `json:"accessLogRotateSpan"`
+	AccessLogMaxBackups int    `json:"accessLogMaxBackups"`
+	MetricsMaxFiles     int    `json:"metricsMaxFiles"`
+
+	// the parsed values, filled by the validate
+	blacklist        []*accessRule
+	cacheTTL         time.Duration
+	negativeTTL      time.Duration
+	maxCacheTTL      time.Duration
+	drainTimeout     time.Duration
+	httpsRedirect    hostSet
+	hsts             hostSet
+	backends         []*backend
+	cachePolicyRules []*cachePolicyRule
+}
+
+// the settings can be applied without a restart, the rest only take effect after a restart.
+// The size and the life of the cache are fixed when it's created on start, so the cacheSize,
+// globCacheSize, cacheTTL, maxCacheTTL, serveStale and maxStale need a restart.
+var liveConfigKeys = map[string]bool{
+	"ctrlAddr":          true,
+	"backendHealthPath": true,
+	"overload":          true,
+	"blackList":         true,
+	"negativeTTL":       true,
+	"maxCacheableSize":  true,
+	"cachePolicy":       true,
+	"httpsRedirect":     true,
+	"hsts":              true,
+	"hstsMaxAge":        true,
+	"drainTimeout":      true,
+	"ctrlAuthKey":       true,
+	"metricsMaxFiles":   true,
+	"maxRequestBody":    true,
+	"maxFnRunCount":     true,
+	"gzipMinSize":       true,
+	"brotliMinSize":     true,
+	"zstdMinSize":       true,
+	"httpTimeout":       true,
+	"zstd":              true,
+}
+
+// used by the AppContext without a config, such as the one in the tests,
+// the limits of the gisp keep their defaults
+var emptyConfig = &Config{
+	MaxRequestBody: 1024 * 1024,
+	MaxFnRunCount:  1000000,
+	GzipMinSize:    256,
+	BrotliMinSize:  256,
+	ZstdMinSize:    1024,
+	HTTPTimeout:    3,
+}
+
+// where the config comes from, so that it can be resolved again on reload
+type configSource struct {
+	path  string
+	flags *Config         // the config parsed from the flags and the env
+	set   map[string]bool // the flags set by the command line or the env, they take precedence over the file
+}
+
+// the optional config file is the only positional arg, the flags after it are rejected
+func parseConfigFlags(args []string) (*configSource, error) {
+	conf := &Config{}
+	src := &configSource{flags: conf, set: map[string]bool{}}
+
+	usr, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	// the env name of each flag, such as portalCacheTTL of the cacheTTL
+	envs := map[string]string{}
+	strVar := func(p *string, name string, env string, value string, usage string) {
+		envs[name] = env
+		flag.StringVar(p, name, utils.LookupStrEnv(env, value), usage)
+	}
+	intVar := func(p *int, name string, env string, value int, usage string) {
+		envs[name] = env
+		flag.IntVar(p, name, utils.LookupIntEnv(env, value), usage)
+	}
+	boolVar := func(p *bool, name string, env string, value bool, usage string) {
+		envs[name] = env
+		flag.BoolVar(p, name, utils.LookupBoolEnv(env, value), usage)
+	}
+
+	strVar(&src.path, "config", "portalConfig", "", "path of the yaml or json config file, the keys are the flag names, the env and the flags take precedence, reloaded on SIGHUP")
+
+	strVar(&conf.Addr, "addr", "portalAddr", ":7070", "file service address")
+	strVar(&conf.CtrlServiceAddr, "fileAddr", "portalFileAddr", "127.0.0.1:7071", "backend file service address")
+	strVar(&conf.FileServiceAddr, "ctrlAddr", "portalCtrlAddr", "127.0.0.1:7000", "control file service addresses, separated by comma, such as 10.0.0.1:7000@3,10.0.0.2:7000, the number after @ is the weight")
+	strVar(&conf.BackendHealthPath, "backendHealthPath", "portalBackendHealthPath", "/", "the path to probe the health of the file service")
+	intVar(&conf.BackendProbeSpan, "backendProbeSpan", "portalBackendProbeSpan", 3, "seconds between the health probes of the file service, 0 to disable")
+	intVar(&conf.CacheSize, "cacheSize", "portalCacheSize", 2*1024*1024*1024, "cache size, default 2GB")
+	intVar(&conf.GlobCacheSize, "globCacheSize", "portalGlobCacheSize", 300*1024*1024, "cache size, default 300MB")
+	strVar(&conf.DbPath, "dbPath", "portalDbPath", path.Join(usr.HomeDir, ".portm-portal.db"), "path of the database file")
+	intVar(&conf.Overload, "overload", "portalOverload", 300, "cache overload number")
+	strVar(&conf.Blacklist, "blackList", "portalBlacklist", "", "uri prefixes separated by comma to deny, deprecated, use the access rules of the control service instead")
+	intVar(&conf.PersistMaxAge, "persistMaxAge", "portalPersistMaxAge", 24*60*60, "max age in seconds of the persisted file cache to restore, 0 to disable persistence, default 1 day")
+
+	boolVar(&conf.ServeStale, "serveStale", "portalServeStale", false, "serve the expired or failed file while revalidating it in background")
+	intVar(&conf.MaxStale, "maxStale", "portalMaxStale", 60*60, "max seconds a file can be served stale, default 1 hour")
+
+	intVar(&conf.CacheTTL, "cacheTTL", "portalCacheTTL", 10*60, "default seconds to cache a file, the Portm-Cache-TTL header of the file overrides it, default 10 minutes")
+	intVar(&conf.NegativeTTL, "negativeTTL", "portalNegativeTTL", 30, "default seconds to cache a not found file, the Portm-Negative-TTL header of the file overrides it, default 30 seconds")
+	intVar(&conf.MaxCacheTTL, "maxCacheTTL", "portalMaxCacheTTL", 24*60*60, "max seconds to cache a file, default 1 day")
+
+	strVar(&conf.SubscribePath, "subscribePath", "portalSubscribePath", "", "the path of the change feed of the file service, such as /api/changes, empty to disable the subscription")
+	strVar(&conf.Peers, "peers", "portalPeers", "", "control service addresses of all the other portal nodes, separated by comma, the invalidations and purges received by this node will be forwarded to them, requires the ctrlAuthKey")
+	boolVar(&conf.Zstd, "zstd", "portalZstd", false, "precompute the zstd variant of the text files besides gzip and brotli")
+	intVar(&conf.MaxCacheableSize, "maxCacheableSize", "portalMaxCacheableSize", 10*1024*1024, "max size of a binary file to be held in the memory cache, the larger ones will be streamed, 0 to disable, default 10MB")
+	strVar(&conf.DiskCacheDir, "diskCacheDir", "portalDiskCacheDir", "", "directory to spill the large binary files to, empty to stream them from the backend on every request")
+	intVar(&conf.MaxVariants, "maxVariants", "portalMaxVariants", 16, "max number of the variants of a uri selected by the Portm-Vary header, the least recently added one will be evicted")
+	strVar(&conf.CachePolicy, "cachePolicy", "portalCachePolicy", "", "path of the json file of the cache policy rules, the rules edited by the control service take precedence")
+	strVar(&conf.TLSAddr, "tlsAddr", "portalTLSAddr", "", "https file service address, such as :443, empty to disable")
+	strVar(&conf.CertDir, "certDir", "portalCertDir", "", "directory of the {name}.crt and {name}.key pairs, the certificate is picked by the host via SNI")
+	intVar(&conf.CertReloadSpan, "certReloadSpan", "portalCertReloadSpan", 10, "seconds between the checks of the changes of the certDir")
+	strVar(&conf.HTTPSRedirect, "httpsRedirect", "portalHTTPSRedirect", "", "hosts separated by comma to redirect from http to https, such as a.com,*.b.com, * for all")
+	strVar(&conf.HSTS, "hsts", "portalHSTS", "", "hosts separated by comma to respond the Strict-Transport-Security header, such as a.com,*.b.com, * for all")
+	intVar(&conf.HSTSMaxAge, "hstsMaxAge", "portalHSTSMaxAge", 365*24*60*60, "max-age of the Strict-Transport-Security header, default 1 year")
+	intVar(&conf.DrainTimeout, "drainTimeout", "portalDrainTimeout", 30, "max seconds to wait for the active requests to finish on shutdown")
+	intVar(&conf.MaxRequestBody, "maxRequestBody", "portalMaxRequestBody", 1024*1024, "max size of the response body of the http request made by gisp, default 1MB")
+	intVar(&conf.MaxFnRunCount, "maxFnRunCount", "portalMaxFnRunCount", 1000000, "max number of the function calls of a gisp run")
+	intVar(&conf.GzipMinSize, "gzipMinSize", "portalGzipMinSize", 256, "min size of the text files to be gzipped")
+	intVar(&conf.BrotliMinSize, "brotliMinSize", "portalBrotliMinSize", 256, "min size of the text files to be compressed by brotli")
+	intVar(&conf.ZstdMinSize, "zstdMinSize", "portalZstdMinSize", 1024, "min size of the text files to be compressed by zstd")
+	intVar(&conf.HTTPTimeout, "httpTimeout", "portalHTTPTimeout", 3, "timeout in seconds of the http request made by gisp, 0 for no timeout")
+
+	strVar(&conf.CtrlAuthKey, "ctrlAuthKey", "portalCtrlAuthKey", "", "the bootstrap admin key of the control service, the control service requires auth when it's set or any key is created, the peers authenticate to each other with it, so they should share the same one")
+
+	strVar(&conf.AccessLog, "accessLog", "portalAccessLog", "", "path of the access log of the file service, - for the stdout, empty to disable")
+	strVar(&conf.AccessLogFormat, "accessLogFormat", "portalAccessLogFormat", "json", "format of the access log, json or combined")
+	intVar(&conf.AccessLogMaxSize, "accessLogMaxSize", "portalAccessLogMaxSize", 100, "max MB of the access log before it's rotated, 0 to disable")
+	intVar(&conf.AccessLogRotateSpan, "accessLogRotateSpan", "portalAccessLogRotateSpan", 24*60*60, "max seconds of the access log before it's rotated, 0 to disable, default 1 day")
+	intVar(&conf.AccessLogMaxBackups, "accessLogMaxBackups", "portalAccessLogMaxBackups", 7, "max number of the gzipped rotated access logs to keep, 0 to keep all")
+
+	intVar(&conf.MetricsMaxFiles, "metricsMaxFiles", "portalMetricsMaxFiles", 100, "max number of the files of the per-file series of the /metrics, the most costly ones are kept")
+
+	flag.CommandLine.Parse(args)
+
+	if flag.NArg() > 1 {
+		return nil, errors.New("config: unexpected args after the config file: " + strings.Join(flag.Args()[1:], " "))
+	}
+
+	if src.path == "" {
+		src.path = flag.Arg(0)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		src.set[f.Name] = true
+	})
+
+	for name, env := range envs {
+		if _, has := os.LookupEnv(env); has {
+			src.set[name] = true
+		}
+	}
+
+	return src, nil
+}
+
+// read the config file over the flags, then validate the result
+func (src *configSource) resolve() (*Config, error) {
+	conf := *src.flags
+
+	if src.path != "" {
+		data, err := ioutil.ReadFile(src.path)
+		if err != nil {
+			return nil, err
+		}
+
+		dict, err := parseConfigFile(src.path, data)
+		if err != nil {
+			return nil, errors.New("config file: " + err.Error())
+		}
+
+		for name := range src.set {
+			delete(dict, name)
+		}
+
+		err = conf.patch(dict)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := conf.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+// the yaml is converted to json, so that both of them share the same keys and checks
+func parseConfigFile(p string, data []byte) (map[string]json.RawMessage, error) {
+	dict := map[string]json.RawMessage{}
+
+	switch path.Ext(p) {
+	case ".yaml", ".yml":
+		values := map[string]interface{}{}
+		err := yaml.Unmarshal(data, &values)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range values {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, errors.New(key + ": " + err.Error())
+			}
+			dict[key] = data
+		}
+	default:
+		err := json.Unmarshal(data, &dict)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dict, nil
+}
+
+// set the fields by the json keys, the unknown keys are rejected
+func (conf *Config) patch(dict map[string]json.RawMessage) error {
+	data, _ := json.Marshal(dict)
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(conf)
+	if err != nil {
+		return errors.New("config: " + err.Error())
+	}
+	return nil
+}
+
+// the placeholder of the secrets in the shown config
+const maskedSecret = "******"
+
+// the copy of the config to show, the secrets are masked
+func (conf *Config) masked() *Config {
+	masked := *conf
+	if masked.CtrlAuthKey != "" {
+		masked.CtrlAuthKey = maskedSecret
+	}
+	return &masked
+}
+
+func (conf *Config) toMap() map[string]interface{} {
+	data, _ := json.Marshal(conf)
+	dict := map[string]interface{}{}
+	json.Unmarshal(data, &dict)
+	return dict
+}
+
+// check the settings and fill the parsed values
+func (conf *Config) validate() error {
+	for name, n := range map[string]int{
+		"cacheSize":      conf.CacheSize,
+		"globCacheSize":  conf.GlobCacheSize,
+		"overload":       conf.Overload,
+		"maxRequestBody": conf.MaxRequestBody,
+		"maxFnRunCount":  conf.MaxFnRunCount,
+	} {
+		if n < 1 {
+			return errors.New("config: " + name + " should be positive")
+		}
+	}
+
+	for name, n := range map[string]int{
+		"backendProbeSpan":    conf.BackendProbeSpan,
+		"persistMaxAge":       conf.PersistMaxAge,
+		"maxStale":            conf.MaxStale,
+		"cacheTTL":            conf.CacheTTL,
+		"negativeTTL":         conf.NegativeTTL,
+		"maxCacheTTL":         conf.MaxCacheTTL,
+		"maxCacheableSize":    conf.MaxCacheableSize,
+		"maxVariants":         conf.MaxVariants,
+		"certReloadSpan":      conf.CertReloadSpan,
+		"hstsMaxAge":          conf.HSTSMaxAge,
+		"drainTimeout":        conf.DrainTimeout,
+		"gzipMinSize":         conf.GzipMinSize,
+		"brotliMinSize":       conf.BrotliMinSize,
+		"zstdMinSize":         conf.ZstdMinSize,
+		"httpTimeout":         conf.HTTPTimeout,
+		"accessLogMaxSize":    conf.AccessLogMaxSize,
+		"accessLogRotateSpan": conf.AccessLogRotateSpan,
+		"accessLogMaxBackups": conf.AccessLogMaxBackups,
+		"metricsMaxFiles":     conf.MetricsMaxFiles,
+	} {
+		if n < 0 {
+			return errors.New("config: " + name + " should not be negative")
+		}
+	}
+
+	if conf.Addr == "" || conf.CtrlServiceAddr == "" || conf.DbPath == "" {
+		return errors.New("config: addr, fileAddr and dbPath are required")
+	}
+
+	// the peers authenticate to each other by the bootstrap key, the keys in the db are local to each node
+	if conf.Peers != "" && conf.CtrlAuthKey == "" {
+		return errors.New("config: peers require the ctrlAuthKey")
+	}
+
+	if conf.AccessLogFormat != "json" && conf.AccessLogFormat != "combined" {
+		return errors.New("config: accessLogFormat should be json or combined")
+	}
+
+	backends, err := parseBackends(conf.FileServiceAddr)
+	if err != nil {
+		return errors.New("config: ctrlAddr: " + err.Error())
+	}
+
+	rules := []*cachePolicyRule{}
+	if conf.CachePolicy != "" {
+		data, err := ioutil.ReadFile(conf.CachePolicy)
+		if err == nil {
+			rules, err = parseCachePolicyRules(data)
+		}
+		if err != nil {
+			return errors.New("config: cachePolicy: " + err.Error())
+		}
+	}
+
+	conf.blacklist = newBlacklistRules(strings.Split(conf.Blacklist, ","))
+	conf.cacheTTL = time.Duration(conf.CacheTTL) * time.Second
+	conf.negativeTTL = time.Duration(conf.NegativeTTL) * time.Second
+	conf.maxCacheTTL = time.Duration(conf.MaxCacheTTL) * time.Second
+	conf.drainTimeout = time.Duration(conf.DrainTimeout) * time.Second
+	conf.httpsRedirect = newHostSet(conf.HTTPSRedirect)
+	conf.hsts = newHostSet(conf.HSTS)
+	conf.backends = backends
+	conf.cachePolicyRules = rules
+
+	return nil
+}
+
+// CheckConfig validates the config of the args, such as "-config portal.yaml",
+// then prints the resolved result
+func CheckConfig(args []string) error {
+	src, err := parseConfigFlags(args)
+	if err != nil {
+		return err
+	}
+
+	conf, err := src.resolve()
+	if err != nil {
+		return err
+	}
+
+	data, _ := json.MarshalIndent(conf.masked(), "", "  ")
+	fmt.Println(string(data))
+
+	return nil
+}
+
+// the current config
+func (appCtx *AppContext) conf() *Config {
+	if conf, ok := appCtx.config.Load().(*Config); ok {
+		return conf
+	}
+	return emptyConfig
+}
+
+// Apply the validated config at once, the settings need a restart are kept as they are.
+// Returns the keys of the changed settings.
+func (appCtx *AppContext) applyConfig(next *Config) (applied []string, restart []string, err error) {
+	appCtx.configLock.Lock()
+	defer appCtx.configLock.Unlock()
+
+	prev := appCtx.conf()
+	prevMap := prev.toMap()
+	nextMap := next.toMap()
+
+	patch := map[string]json.RawMessage{}
+
+	for key, value := range nextMap {
+		if reflect.DeepEqual(prevMap[key], value) {
+			continue
+		}
+
+		if liveConfigKeys[key] {
+			applied = append(applied, key)
+		} else {
+			restart = append(restart, key)
+			data, _ := json.Marshal(prevMap[key])
+			patch[key] = data
+		}
+	}
+
+	sort.Strings(applied)
+	sort.Strings(restart)
+
+	conf := *next
+	err = conf.patch(patch)
+	if err == nil {
+		err = conf.validate()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appCtx.backends.setList(conf.backends, conf.BackendHealthPath)
+	appCtx.cachePolicy.use(conf.CachePolicy, conf.cachePolicyRules)
+	atomic.StoreInt32(&appCtx.overload, int32(conf.Overload))
+	atomic.StoreInt32(&appCtx.glob.overload, int32(conf.Overload))
+
+	appCtx.config.Store(&conf)
+
+	return applied, restart, nil
+}
+
+func (appCtx *AppContext) reloadConfig() (applied []string, restart []string, err error) {
+	conf, err := appCtx.configSource.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return appCtx.applyConfig(conf)
+}
+
+func (appCtx *AppContext) reloadConfigOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		applied, restart, err := appCtx.reloadConfig()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reload config error:\n"+err.Error())
+			continue
+		}
+
+		fmt.Println("config reloaded, applied:", applied, "need restart:", restart)
+	}
+}
+
+// curl 127.0.0.1:7071/config
+// curl -d '{"overload": 500, "blackList": "http://a.com/"}' 127.0.0.1:7071/config
+// curl 127.0.0.1:7071/config?action=reload
+// The posted changes are not written to the config file, the next reload drops them,
+// the response tells it by the "transient".
+func (appCtx *AppContext) handleConfig(ctx *fasthttp.RequestCtx) {
+	var applied, restart []string
+	var err error
+
+	if ctx.IsPost() {
+		patch := map[string]json.RawMessage{}
+		err = json.Unmarshal(ctx.PostBody(), &patch)
+
+		// the shown config can be posted back as it is, the masked secret keeps the current one
+		if value, has := patch["ctrlAuthKey"]; has && string(value) == `"`+maskedSecret+`"` {
+			delete(patch, "ctrlAuthKey")
+		}
+
+		conf := *appCtx.conf()
+		if err == nil {
+			err = conf.patch(patch)
+		}
+		if err == nil {
+			err = conf.validate()
+		}
+		if err == nil {
+			applied, restart, err = appCtx.applyConfig(&conf)
+		}
+	} else if string(ctx.QueryArgs().Peek("action")) == "reload" {
+		applied, restart, err = appCtx.reloadConfig()
+	}
+
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"config":    appCtx.conf().masked(),
+		"path":      appCtx.configSource.path,
+		"applied":   applied,
+		"restart":   restart,
+		"transient": ctx.IsPost() && len(applied) > 0,
+	})
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(data)
+}
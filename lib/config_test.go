@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Addr:            ":7070",
+		CtrlServiceAddr: "127.0.0.1:7071",
+		FileServiceAddr: "127.0.0.1:7000",
+		DbPath:          "/tmp/portal.db",
+		CacheSize:       1024,
+		GlobCacheSize:   1024,
+		Overload:        300,
+		CacheTTL:        60,
+		MaxRequestBody:  1024,
+		MaxFnRunCount:   1024,
+		AccessLogFormat: "json",
+	}
+}
+
+func TestConfigResolve(t *testing.T) {
+	f, _ := ioutil.TempFile("", "portal-config")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"overload": 10, "cacheTTL": 30}`)
+	f.Close()
+
+	src := &configSource{
+		path:  f.Name(),
+		flags: testConfig(),
+		set:   map[string]bool{"cacheTTL": true},
+	}
+
+	conf, err := src.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, 10, conf.Overload)
+	assert.Equal(t, 60, conf.CacheTTL)
+
+	ioutil.WriteFile(f.Name(), []byte(`{"unknown": 1}`), 0644)
+	_, err = src.resolve()
+	assert.NotNil(t, err)
+
+	ioutil.WriteFile(f.Name(), []byte(`{"overload": 0}`), 0644)
+	_, err = src.resolve()
+	assert.NotNil(t, err)
+}
+
+func TestConfigYAML(t *testing.T) {
+	dict, err := parseConfigFile("portal.yaml", []byte("overload: 10\nserveStale: true\nblackList: http://a.com/\n"))
+	assert.Nil(t, err)
+
+	conf := testConfig()
+	assert.Nil(t, conf.patch(dict))
+	assert.Equal(t, 10, conf.Overload)
+	assert.Equal(t, true, conf.ServeStale)
+	assert.Equal(t, "http://a.com/", conf.Blacklist)
+
+	_, err = parseConfigFile("portal.json", []byte("overload: 10"))
+	assert.NotNil(t, err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	appCtx := &AppContext{
+		configLock:  &sync.Mutex{},
+		backends:    newBackendPool("127.0.0.1:7000", "/", 0),
+		cachePolicy: &cachePolicyTable{lock: &sync.RWMutex{}},
+		glob:        &globCache{},
+	}
+
+	conf := testConfig()
+	assert.Nil(t, conf.validate())
+	appCtx.config.Store(conf)
+
+	next := *conf
+	next.Overload = 10
+	next.FileServiceAddr = "127.0.0.1:7001,127.0.0.1:7002"
+	next.Addr = ":8080"
+	next.CacheSize = 2048
+	next.CacheTTL = 30
+	next.ServeStale = !conf.ServeStale
+	assert.Nil(t, next.validate())
+
+	applied, restart, err := appCtx.applyConfig(&next)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ctrlAddr", "overload"}, applied)
+	assert.Equal(t, []string{"addr", "cacheSize", "cacheTTL", "serveStale"}, restart)
+
+	assert.Equal(t, ":7070", appCtx.conf().Addr)
+	assert.Equal(t, conf.ServeStale, appCtx.conf().ServeStale)
+	assert.Equal(t, 60, appCtx.conf().CacheTTL)
+	assert.Equal(t, int32(10), appCtx.overload)
+	assert.Equal(t, 2, len(appCtx.backends.getList()))
+}
+
+func TestParseConfigFlags(t *testing.T) {
+	parse := func(args ...string) (*configSource, error) {
+		flag.CommandLine = flag.NewFlagSet("portal", flag.ContinueOnError)
+		return parseConfigFlags(args)
+	}
+
+	// the env name doesn't have to match the case of the flag name
+	os.Setenv("portalBlacklist", "http://a.com/")
+	defer os.Unsetenv("portalBlacklist")
+
+	src, err := parse("-overload", "10", "portal.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "portal.yaml", src.path)
+	assert.Equal(t, map[string]bool{"overload": true, "blackList": true}, src.set)
+	assert.Equal(t, "http://a.com/", src.flags.Blacklist)
+
+	_, err = parse("portal.yaml", "-overload", "10")
+	assert.EqualError(t, err, "config: unexpected args after the config file: -overload 10")
+}
+
+func TestConfigPeersAuth(t *testing.T) {
+	conf := testConfig()
+	conf.Peers = "10.0.0.2:7071"
+	assert.EqualError(t, conf.validate(), "config: peers require the ctrlAuthKey")
+
+	conf.CtrlAuthKey = "secret"
+	assert.Nil(t, conf.validate())
+
+	assert.Equal(t, "******", conf.masked().CtrlAuthKey)
+	assert.Equal(t, "secret", conf.CtrlAuthKey)
+	assert.Equal(t, "", testConfig().masked().CtrlAuthKey)
+}
+
+func TestHandleConfigMasked(t *testing.T) {
+	appCtx := &AppContext{
+		configLock:   &sync.Mutex{},
+		configSource: &configSource{},
+		backends:     newBackendPool("127.0.0.1:7000", "/", 0),
+		cachePolicy:  &cachePolicyTable{lock: &sync.RWMutex{}},
+		glob:         &globCache{},
+	}
+
+	conf := testConfig()
+	conf.CtrlAuthKey = "secret"
+	assert.Nil(t, conf.validate())
+	appCtx.config.Store(conf)
+
+	// the shown config is posted back with a change
+	shown, _ := json.Marshal(conf.masked())
+	patch := map[string]interface{}{}
+	json.Unmarshal(shown, &patch)
+	patch["overload"] = 10
+	body, _ := json.Marshal(patch)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetBody(body)
+	appCtx.handleConfig(ctx)
+
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, 10, appCtx.conf().Overload)
+	assert.Equal(t, "secret", appCtx.conf().CtrlAuthKey)
+}
@@ -2,14 +2,10 @@ package lib
 
 import (
 	"encoding/json"
-	"flag"
 	"io/ioutil"
-	"net/http"
-	"net/url"
-	"os/user"
-	"path"
-	"strings"
+	"os"
 	"sync"
+	"sync/atomic"
 
 	"time"
 
@@ -19,70 +15,98 @@ import (
 
 // AppContext ...
 type AppContext struct {
+	config          atomic.Value // *Config
+	configSource    *configSource
+	configLock      *sync.Mutex
 	cache           *umi.Cache
 	glob            *globCache
 	log             *logCache
 	cost            *costCache
 	overloadMointer *overloadMonitor
 	runtimeCache    *runtimeCache
+	fileStore       *fileStore
+	warmup          *warmup
+	subscription    *subscription
+	peers           *peerGroup
+	tlsAddr         string
+	certs           *certStore
+	auth            *authStore
+	access          *accessTable
+	rateLimiter     *rateLimiter
+	accessLog       *accessLog
+	fileStats       fileCacheStats
+	variants        *variantIndex
+	cachePolicy     *cachePolicyTable
+	diskCacheDir    string
 	addr            string
 	ctrlServiceAddr string
-	fileServiceAddr string
+	backends        *backendPool
 	dbPath          string
 	overload        int32
 	proxyMap        *utils.PrefixMap
 	reqCount        *reqCount
 	queryPrefix     []byte
 	globLock        *sync.Mutex
-	workingLock     *sync.Mutex
+	fetching        *utils.FlightGroup
 	workingCount    int32
-	blacklist       []string
+	activeCount     int32 // the requests being handled by the file service and the test queries
+	draining        int32
 }
 
 // NewAppContext ...
 func NewAppContext() *AppContext {
-	var addr, ctrlServiceAddr, fileServiceAddr, dbPath, blacklist string
-	var cacheSize, globCacheSize, overload int
-
-	usr, err := user.Current()
+	src, err := parseConfigFlags(os.Args[1:])
 	if err != nil {
 		panic(err)
 	}
 
-	flag.StringVar(&addr, "addr", utils.LookupStrEnv("portalAddr", ":7070"), "file service address")
-	flag.StringVar(&ctrlServiceAddr, "fileAddr", utils.LookupStrEnv("portalFileAddr", "127.0.0.1:7071"), "backend file service address")
-	flag.StringVar(&fileServiceAddr, "ctrlAddr", utils.LookupStrEnv("portalCtrlAddr", "127.0.0.1:7000"), "control file service address")
-	flag.IntVar(&cacheSize, "cacheSize", utils.LookupIntEnv("portalCacheSize", 2*1024*1024*1024), "cache size, default 2GB")
-	flag.IntVar(&globCacheSize, "globCacheSize", utils.LookupIntEnv("portalGlobCacheSize", 300*1024*1024), "cache size, default 300MB")
-	flag.StringVar(&dbPath, "dbPath", utils.LookupStrEnv("portalDbPath", path.Join(usr.HomeDir, ".portm-portal.db")), "path of the database file")
-	flag.IntVar(&overload, "overload", utils.LookupIntEnv("portalOverload", 300), "cache overload number")
-	flag.StringVar(&blacklist, "blackList", utils.LookupStrEnv("portalBlacklist", ""), "uri prefix black list")
+	conf, err := src.resolve()
+	if err != nil {
+		panic(err)
+	}
 
-	flag.Parse()
+	initDb(conf.DbPath)
 
-	initDb(dbPath)
+	if conf.DiskCacheDir != "" {
+		err = os.MkdirAll(conf.DiskCacheDir, 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	rc := newReqCount()
 
 	go rc.worker()
 
+	// each file expires on its own schedule, the cache only drops the ones
+	// that can never be used again
+	cacheLife := conf.maxCacheTTL
+	if conf.cacheTTL > cacheLife {
+		cacheLife = conf.cacheTTL
+	}
+
+	// keep the expired files in memory, so that they can be served stale
+	if conf.ServeStale {
+		cacheLife += time.Duration(conf.MaxStale) * time.Second
+	}
+
 	cache := umi.New(&umi.Options{
-		MaxMemSize:  uint64(cacheSize),
+		MaxMemSize:  uint64(conf.CacheSize),
 		PromoteRate: -1,
-		TTL:         10 * time.Minute,
+		TTL:         cacheLife,
 	})
 
 	glob := &globCache{
 		lock:     &sync.Mutex{},
 		count:    0,
-		overload: int32(overload),
+		overload: int32(conf.Overload),
 		descCache: umi.New(&umi.Options{
-			MaxMemSize:  uint64(globCacheSize),
+			MaxMemSize:  uint64(conf.GlobCacheSize),
 			PromoteRate: -1,
 			GCSize:      -1,
 		}),
 		ascCache: umi.New(&umi.Options{
-			MaxMemSize:  uint64(globCacheSize),
+			MaxMemSize:  uint64(conf.GlobCacheSize),
 			PromoteRate: -1,
 			GCSize:      -1,
 		}),
@@ -90,7 +114,9 @@ func NewAppContext() *AppContext {
 
 	rtCache := newRuntimeCache()
 
-	return &AppContext{
+	store := newFileStore(time.Duration(conf.PersistMaxAge) * time.Second)
+
+	appCtx := &AppContext{
 		cache: cache,
 		glob:  glob,
 		log: &logCache{
@@ -100,41 +126,60 @@ func NewAppContext() *AppContext {
 				GCSize:      -1,
 			}),
 		},
-		overloadMointer: newOverloadMointer(&overloadOptions{
-			fileHandler: func(uri string) {
-				cache.Del(uri)
-				rtCache.flush(uri)
-			},
-			globHandler: func(uri string, desc bool) {
-				glob.getCache(desc).Del(uri)
-				rtCache.flush(uri)
-			},
-		}),
 		runtimeCache:    rtCache,
+		fileStore:       store,
+		warmup:          newWarmup(),
+		subscription:    newSubscription(conf.SubscribePath),
+		peers:           newPeerGroup(conf.Peers),
+		tlsAddr:         conf.TLSAddr,
+		auth:            newAuthStore(),
+		access:          newAccessTable(),
+		rateLimiter:     newRateLimiter(),
+		accessLog:       newAccessLog(conf.AccessLog, conf.AccessLogFormat, int64(conf.AccessLogMaxSize)*1024*1024, time.Duration(conf.AccessLogRotateSpan)*time.Second, conf.AccessLogMaxBackups),
+		certs:           newCertStore(conf.CertDir, time.Duration(conf.CertReloadSpan)*time.Second),
+		variants:        newVariantIndex(conf.MaxVariants),
+		cachePolicy:     newCachePolicyTable(conf.CachePolicy),
+		diskCacheDir:    conf.DiskCacheDir,
 		cost:            newCostCache(),
-		addr:            addr,
-		ctrlServiceAddr: ctrlServiceAddr,
-		fileServiceAddr: fileServiceAddr,
-		dbPath:          dbPath,
-		overload:        int32(overload),
+		addr:            conf.Addr,
+		ctrlServiceAddr: conf.CtrlServiceAddr,
+		backends:        newBackendPool(conf.FileServiceAddr, conf.BackendHealthPath, time.Duration(conf.BackendProbeSpan)*time.Second),
+		dbPath:          conf.DbPath,
+		overload:        int32(conf.Overload),
+		configSource:    src,
+		configLock:      &sync.Mutex{},
 		proxyMap: &utils.PrefixMap{
 			Lock: &sync.RWMutex{},
 			Dist: make(map[string]interface{}),
 		},
 		reqCount:     rc,
 		queryPrefix:  []byte("query."),
-		workingLock:  &sync.Mutex{},
+		fetching:     utils.NewFlightGroup(),
 		workingCount: 0,
-		blacklist:    strings.Split(blacklist, ","),
 	}
+
+	appCtx.config.Store(conf)
+
+	appCtx.overloadMointer = newOverloadMointer(&overloadOptions{
+		fileHandler: appCtx.retryFile,
+		globHandler: func(uri string, desc bool) {
+			glob.getCache(desc).Del(uri)
+			rtCache.flush(uri)
+		},
+	})
+
+	appCtx.log.load()
+	appCtx.cost.load()
+
+	go appCtx.topURIsWorker()
+	go appCtx.rateLimiter.worker()
+	go appCtx.reloadConfigOnSignal()
+
+	return appCtx
 }
 
 func (appCtx *AppContext) rpc(result interface{}, nisp string) error {
-	res, err := http.Post((&url.URL{
-		Scheme: "http",
-		Host:   appCtx.fileServiceAddr,
-		Path:   "/api/nisp",
-	}).String(), "", strings.NewReader(nisp))
+	res, err := appCtx.backends.post("/api/nisp", nisp)
 
 	if err != nil {
 		return err
@@ -2,11 +2,13 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 
 	"time"
@@ -34,28 +36,38 @@ func (appCtx *AppContext) clearDependents(uri string) {
 	}
 }
 
-// curl 127.0.0.1:7070/?action=update&uri=test.com
-func (appCtx *AppContext) updateFile(ctx *fasthttp.RequestCtx) {
-	action := string(ctx.QueryArgs().Peek("action"))
-	uri := string(ctx.QueryArgs().Peek("uri"))
+var errBadAction = errors.New("bad action")
 
+// apply the change of a file in the backend to the caches
+func (appCtx *AppContext) changeFile(action string, uri string) error {
 	switch action {
 	case "create":
-		file := appCtx.requestFile(uri)
+		file, err := appCtx.requestFile(uri, nil)
+		if err != nil && appCtx.keepStale(uri) {
+			return err
+		}
 		if file.Type == fileTypeProxy {
 			appCtx.proxyMap.Set(uri, file)
 		}
-		appCtx.cache.Set(uri, file)
+		// the variants of the uri created again are stale
+		appCtx.dropVariants(uri)
+		appCtx.setFile(uri, file)
 		appCtx.glob.UpdateToList(uri)
 		appCtx.runtimeCache.flush(uri)
 
 	case "update":
-		file := appCtx.requestFile(uri)
+		// the explicit update skips the validators, the backend may keep the
+		// same Portm-Id for a changed file and answer 304
+		file, err := appCtx.requestFile(uri, nil)
+		if err != nil && appCtx.keepStale(uri) {
+			return err
+		}
 		if file.Type == fileTypeProxy {
 			appCtx.proxyMap.Set(uri, file)
 		}
 		appCtx.clearDependents(uri)
-		appCtx.cache.Set(uri, file)
+		appCtx.dropVariants(uri)
+		appCtx.setFile(uri, file)
 		appCtx.glob.UpdateToList(uri)
 		appCtx.runtimeCache.flush(uri)
 
@@ -63,12 +75,40 @@ func (appCtx *AppContext) updateFile(ctx *fasthttp.RequestCtx) {
 		appCtx.proxyMap.Del(uri)
 		appCtx.glob.DelFromList(uri)
 		appCtx.clearDependents(uri)
-		appCtx.cache.Del(uri)
+		appCtx.dropVariants(uri)
+		appCtx.delFile(uri)
 		appCtx.runtimeCache.flush(uri)
 
 	default:
-		ctx.Error("bad action", 400)
+		return errBadAction
 	}
+
+	return nil
+}
+
+// curl 127.0.0.1:7070/?action=update&uri=test.com
+func (appCtx *AppContext) updateFile(ctx *fasthttp.RequestCtx) {
+	action := string(ctx.QueryArgs().Peek("action"))
+	uri := string(ctx.QueryArgs().Peek("uri"))
+
+	args, isNew := appCtx.receiveEvent(ctx)
+	if !isNew {
+		return
+	}
+
+	err := appCtx.changeFile(action, uri)
+
+	if err == errBadAction {
+		ctx.Error(err.Error(), 400)
+		return
+	} else if err != nil {
+		// the peers may still be able to reach the backend
+		ctx.Error(err.Error(), 502)
+		appCtx.forward(string(ctx.Path()), args)
+		return
+	}
+
+	appCtx.fanOut(ctx, args)
 }
 
 func (appCtx *AppContext) status(ctx *fasthttp.RequestCtx) {
@@ -82,6 +122,10 @@ func (appCtx *AppContext) status(ctx *fasthttp.RequestCtx) {
 		"time":         time.Now().UnixNano() / 1000 / 1000,
 		"qpsTime":      appCtx.reqCount.statusCodeLastTime.UnixNano() / 1000 / 1000,
 		"workingCount": appCtx.workingCount,
+		"backends":     appCtx.backends.status(),
+		"subscription": appCtx.subscription.status(),
+		"peers":        appCtx.peers.status(),
+		"accessLog":    appCtx.accessLog.status(),
 		"mem":          m.Sys / 1024,
 	})
 	if err != nil {
@@ -92,7 +136,20 @@ func (appCtx *AppContext) status(ctx *fasthttp.RequestCtx) {
 	ctx.Write(data)
 }
 
+func (appCtx *AppContext) restoreStatus(ctx *fasthttp.RequestCtx) {
+	data, err := json.Marshal(appCtx.fileStore.status())
+	if err != nil {
+		data = []byte(err.Error())
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(data)
+}
+
 func (appCtx *AppContext) testQuery(ctx *fasthttp.RequestCtx) {
+	// the shutdown waits for the gisp run
+	defer appCtx.track()()
+
 	data, err := djson.Decode(ctx.PostBody())
 	if err != nil {
 		ctx.Error(err.Error(), 400)
@@ -159,13 +216,51 @@ func (appCtx *AppContext) logList(ctx *fasthttp.RequestCtx) {
 	ctx.Write(data)
 }
 
+// the latency percentiles the cost list can be sorted by
+var costSortKeys = map[string]func(*latencySummary) float64{
+	"p50": func(s *latencySummary) float64 { return s.P50 },
+	"p90": func(s *latencySummary) float64 { return s.P90 },
+	"p99": func(s *latencySummary) float64 { return s.P99 },
+	"max": func(s *latencySummary) float64 { return s.Max },
+}
+
+// The latencies are in milliseconds over the window, which is 1m, 5m or 15m.
+// curl 127.0.0.1:7071/cost-list?window=5m&sort=p99&offset=0&limit=20
 func (appCtx *AppContext) costList(ctx *fasthttp.RequestCtx) {
 	offset, _ := ctx.QueryArgs().GetUint("offset")
 	limit, _ := ctx.QueryArgs().GetUint("limit")
-	count := appCtx.cost.cache.Count()
-	right := 0
-	offset, right = utils.Slicer(offset, limit, count, 200)
-	items := appCtx.cost.cache.Slice(offset, right)
+
+	window := string(ctx.QueryArgs().Peek("window"))
+	if window == "" {
+		window = "1m"
+	}
+	span, has := latencyWindows[window]
+	if !has {
+		ctx.Error("window should be 1m, 5m or 15m", 400)
+		return
+	}
+
+	sortBy := string(ctx.QueryArgs().Peek("sort"))
+	sortKey, has := costSortKeys[sortBy]
+	if sortBy != "" && !has {
+		ctx.Error("sort should be p50, p90, p99 or max", 400)
+		return
+	}
+
+	// only the files with a latency window are sorted, so that the sort is bounded by the latencyMaxFiles,
+	// the page is sliced after the sort
+	var entries []costEntry
+	count := 0
+	if sortKey == nil {
+		count = appCtx.cost.cache.Count()
+		left, right := utils.Slicer(offset, limit, count, 200)
+		for _, item := range appCtx.cost.cache.Slice(left, right) {
+			entries = append(entries, costEntry{item.Key(), item.Value().(*costInfo)})
+		}
+	} else {
+		entries = appCtx.cost.windowed()
+		count = len(entries)
+	}
 
 	type listItem struct {
 		URI        string
@@ -174,13 +269,21 @@ func (appCtx *AppContext) costList(ctx *fasthttp.RequestCtx) {
 		Concurrent uint32
 		Quota      string
 		Rejected   string
+		Count      uint64
+		P50        float64
+		P90        float64
+		P99        float64
+		Max        float64
+
+		summary *latencySummary
 	}
 
 	list := []listItem{}
+	now := time.Now()
 
-	for _, item := range items {
-		info := item.Value().(*costInfo)
-		uri := item.Key()
+	for _, entry := range entries {
+		info := entry.info
+		uri := entry.uri
 
 		cache, _ := appCtx.cache.Peek(uri)
 
@@ -188,6 +291,8 @@ func (appCtx *AppContext) costList(ctx *fasthttp.RequestCtx) {
 			continue
 		}
 
+		summary := appCtx.cost.summary(info, span, now)
+
 		list = append(list, listItem{
 			URI:        uri,
 			Cost:       strconv.FormatUint(info.cost, 10),
@@ -195,13 +300,33 @@ func (appCtx *AppContext) costList(ctx *fasthttp.RequestCtx) {
 			Concurrent: info.concurrent,
 			QPS:        info.qps,
 			Rejected:   strconv.FormatUint(info.rejected, 10),
+			Count:      summary.Count,
+			P50:        summary.P50,
+			P90:        summary.P90,
+			P99:        summary.P99,
+			Max:        summary.Max,
+			summary:    summary,
 		})
 	}
 
+	if sortKey != nil {
+		sort.Slice(list, func(i, j int) bool {
+			a, b := sortKey(list[i].summary), sortKey(list[j].summary)
+			if a == b {
+				return list[i].URI < list[j].URI
+			}
+			return a > b
+		})
+
+		left, right := utils.Slicer(offset, limit, len(list), 200)
+		list = list[left:right]
+	}
+
 	data, _ := json.Marshal(map[string]interface{}{
-		"count": count,
-		"time":  time.Now().UnixNano() / 1000 / 1000,
-		"list":  list,
+		"count":  count,
+		"time":   now.UnixNano() / 1000 / 1000,
+		"window": window,
+		"list":   list,
 	})
 
 	ctx.SetContentType("application/json; charset=utf-8")
@@ -241,9 +366,23 @@ func (appCtx *AppContext) cacheList(ctx *fasthttp.RequestCtx) {
 
 func (appCtx *AppContext) fileInfo(ctx *fasthttp.RequestCtx) {
 	uri := string(ctx.QueryArgs().Peek("uri"))
-	file, _ := appCtx.cache.Get(uri)
+	value, _ := appCtx.cache.Get(uri)
 
-	data, err := json.Marshal(file)
+	var info interface{}
+	if value != nil {
+		file := value.(*File)
+		info = struct {
+			*File
+			Stale    bool  `json:"stale"`
+			StaleAge int64 `json:"staleAge"`
+		}{
+			File:     file,
+			Stale:    appCtx.isStale(file),
+			StaleAge: appCtx.staleAge(file).Nanoseconds() / 1000 / 1000,
+		}
+	}
+
+	data, err := json.Marshal(info)
 
 	if err != nil {
 		ctx.Error(err.Error(), 500)
@@ -385,15 +524,30 @@ func (appCtx *AppContext) getProxyMap() {
 	}
 
 	for _, uri := range list {
-		appCtx.proxyMap.Set(uri, appCtx.requestFile(uri))
+		file, _ := appCtx.requestFile(uri, nil)
+		appCtx.proxyMap.Set(uri, file)
 	}
 
 	fmt.Println("proxy rules got:", list)
 }
 
 func (appCtx *AppContext) purge(ctx *fasthttp.RequestCtx) {
+	args, isNew := appCtx.receiveEvent(ctx)
+	if !isNew {
+		return
+	}
+
+	appCtx.purgeAll()
+
+	appCtx.fanOut(ctx, args)
+}
+
+func (appCtx *AppContext) purgeAll() {
 	appCtx.overloadMointer.purge()
 	appCtx.cache.Purge()
+	appCtx.variants.purge()
+	appCtx.fileStore.purge()
+	appCtx.purgeDiskCache()
 	appCtx.glob.getCache(true).Purge()
 	appCtx.glob.getCache(false).Purge()
 	appCtx.runtimeCache.purge()
@@ -414,6 +568,10 @@ func (appCtx *AppContext) ControlService() func() {
 	server := &fasthttp.Server{
 		ReadBufferSize: 1024 * 8,
 		Handler: func(ctx *fasthttp.RequestCtx) {
+			if !appCtx.authorize(ctx) {
+				return
+			}
+
 			switch string(ctx.Path()) {
 			case "/file":
 				appCtx.updateFile(ctx)
@@ -428,6 +586,36 @@ func (appCtx *AppContext) ControlService() func() {
 			case "/status":
 				appCtx.status(ctx)
 
+			case "/metrics":
+				appCtx.handleMetrics(ctx)
+
+			case "/warmup":
+				appCtx.handleWarmup(ctx)
+
+			case "/warmup-status":
+				appCtx.warmupStatus(ctx)
+
+			case "/restore-status":
+				appCtx.restoreStatus(ctx)
+
+			case "/cache-policy":
+				appCtx.handleCachePolicy(ctx)
+
+			case "/config":
+				appCtx.handleConfig(ctx)
+
+			case "/cert":
+				appCtx.handleCert(ctx)
+
+			case "/access-rules":
+				appCtx.handleAccessRules(ctx)
+
+			case "/rate-limits":
+				appCtx.handleRateLimits(ctx)
+
+			case "/keys":
+				appCtx.handleKeys(ctx)
+
 			case "/test-query":
 				appCtx.testQuery(ctx)
 
@@ -457,6 +645,8 @@ func (appCtx *AppContext) ControlService() func() {
 
 	appCtx.getProxyMap()
 
+	go appCtx.subscribe()
+
 	go server.Serve(listener)
 
 	fmt.Printf("control service listen on %s\n", appCtx.ctrlServiceAddr)
@@ -14,6 +14,7 @@ type costCache struct {
 	lock         *sync.RWMutex
 	chAdd        chan *costMessage
 	cache        *umi.Cache
+	windows      map[string]*costInfo // the files with a latency window
 	tick         time.Time
 	qpsTimerSpan time.Duration
 }
@@ -30,6 +31,7 @@ type costInfo struct {
 	concurrent uint32
 	qps        uint32
 	rejected   uint64
+	latency    *latencyWindow
 }
 
 var emptyCostInfo = &costInfo{
@@ -48,6 +50,7 @@ func newCostCache() *costCache {
 			MaxMemSize: 100 * 1024 * 1024, // 100MB
 			GCSpan:     -1,
 		}),
+		windows:      map[string]*costInfo{},
 		tick:         time.Time{},
 		qpsTimerSpan: 100 * time.Millisecond,
 	}
@@ -74,6 +77,7 @@ func newCostCache() *costCache {
 
 		cost.lock.Lock()
 		cost.cache.Purge()
+		cost.windows = map[string]*costInfo{}
 		fmt.Println("purge cost list:", time.Now())
 		cost.lock.Unlock()
 	})
@@ -84,11 +88,12 @@ func newCostCache() *costCache {
 
 func (c *costCache) setQPS() {
 	now := time.Now()
-	span := now.Sub(c.tick)
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	span := now.Sub(c.tick)
+
 	items := c.cache.Items()
 
 	for _, item := range items {
@@ -97,6 +102,17 @@ func (c *costCache) setQPS() {
 		info.oldCount = info.count
 	}
 
+	// free the windows of the files evicted from the cache or without a run in the window,
+	// so that the new files can have them
+	for uri, info := range c.windows {
+		if cache, has := c.cache.Peek(uri); !has || cache.(*costInfo) != info {
+			delete(c.windows, uri)
+		} else if info.latency.idle(now) {
+			info.latency = nil
+			delete(c.windows, uri)
+		}
+	}
+
 	c.tick = now
 }
 
@@ -139,13 +155,15 @@ func (c *costCache) end(uri string, num uint64) {
 	cache, has := c.cache.Peek(uri)
 
 	if !has {
-		c.cache.Set(uri, &costInfo{
+		info := &costInfo{
 			cost:       num,
 			count:      1,
 			oldCount:   0,
 			concurrent: 0,
 			rejected:   0,
-		})
+		}
+		c.cache.Set(uri, info)
+		c.record(uri, info, num)
 		c.lock.Unlock()
 		return
 	}
@@ -157,9 +175,53 @@ func (c *costCache) end(uri string, num uint64) {
 	}
 
 	info.cost += num
+
+	c.record(uri, info, num)
+
 	c.lock.Unlock()
 }
 
+// record the latency if the file has a window or there's still room for one,
+// the caller should hold the write lock
+func (c *costCache) record(uri string, info *costInfo, num uint64) {
+	if info.latency == nil {
+		if len(c.windows) >= latencyMaxFiles {
+			return
+		}
+		info.latency = newLatencyWindow()
+		c.windows[uri] = info
+	}
+	info.latency.record(time.Duration(num), time.Now())
+}
+
+type costEntry struct {
+	uri  string
+	info *costInfo
+}
+
+// the files with a latency window, they are at most latencyMaxFiles
+func (c *costCache) windowed() []costEntry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	list := make([]costEntry, 0, len(c.windows))
+	for uri, info := range c.windows {
+		list = append(list, costEntry{uri, info})
+	}
+	return list
+}
+
+// the latency summary of the file over the span before now
+func (c *costCache) summary(info *costInfo, span time.Duration, now time.Time) *latencySummary {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if info.latency == nil {
+		return &latencySummary{}
+	}
+	return info.latency.summary(span, now)
+}
+
 func (c *costCache) many(uri string, quota uint64, concurrent uint32) bool {
 	c.lock.Lock()
 
@@ -220,3 +282,50 @@ func (c *costCache) get(uri string) (info *costInfo) {
 
 	return
 }
+
+const costListKey = "costList"
+
+type costRecord struct {
+	Cost     uint64 `json:"cost"`
+	Count    uint64 `json:"count"`
+	Rejected uint64 `json:"rejected"`
+}
+
+func (c *costCache) save() error {
+	c.lock.RLock()
+	dict := map[string]*costRecord{}
+	for _, item := range c.cache.Items() {
+		info := item.Value().(*costInfo)
+		dict[item.Key()] = &costRecord{
+			Cost:     info.cost,
+			Count:    info.count,
+			Rejected: info.rejected,
+		}
+	}
+	c.lock.RUnlock()
+
+	data, _ := json.Marshal(dict)
+	return db.Put([]byte(costListKey), data, nil)
+}
+
+// restore the cost data saved by the last shutdown
+func (c *costCache) load() {
+	data, err := db.Get([]byte(costListKey), nil)
+	if err != nil {
+		return
+	}
+
+	dict := map[string]*costRecord{}
+	json.Unmarshal(data, &dict)
+
+	c.lock.Lock()
+	for uri, record := range dict {
+		c.cache.Set(uri, &costInfo{
+			cost:     record.Cost,
+			count:    record.Count,
+			oldCount: record.Count,
+			rejected: record.Rejected,
+		})
+	}
+	c.lock.Unlock()
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ysmood/portal/lib/utils"
 )
@@ -25,24 +27,39 @@ func (b StringBytes) MarshalJSON() ([]byte, error) {
 
 // File ...
 type File struct {
-	ID          string      `json:"id"`
-	URI         string      `json:"uri"`
-	Type        FileType    `json:"type"`
-	ModifierID  string      `json:"modifierId"`
-	RootID      string      `json:"rootId"`
-	ModifyTime  string      `json:"modifyTime"`
-	Headers     [][]byte    `json:"-"`
-	ETag        StringBytes `json:"etag,string"`
-	Body        StringBytes `json:"body,string"`
-	GzippedBody []byte      `json:"-"`
-	Code        interface{} `json:"code"`
-	JSONBody    interface{} `json:"-"` // used for gisp cache
-	ContentType string      `json:"-"` // TODO: hack the double set of fasthttp Content-Type header
-	Quota       uint64      `json:"quota"`
-	Cost        uint64      `json:"cost"`
-	Concurrent  uint32      `json:"concurrent"`
-	Count       uint64      `json:"count"`
+	ID          string        `json:"id"`
+	URI         string        `json:"uri"`
+	Type        FileType      `json:"type"`
+	ModifierID  string        `json:"modifierId"`
+	RootID      string        `json:"rootId"`
+	ModifyTime  string        `json:"modifyTime"`
+	Headers     [][]byte      `json:"-"`
+	ETag        StringBytes   `json:"etag,string"`
+	Body        StringBytes   `json:"body,string"`
+	GzippedBody []byte        `json:"-"`
+	BrotliBody  []byte        `json:"-"`
+	ZstdBody    []byte        `json:"-"`
+	Code        interface{}   `json:"code"`
+	JSONBody    interface{}   `json:"-"` // used for gisp cache
+	ContentType string        `json:"-"` // TODO: hack the double set of fasthttp Content-Type header
+	Quota       uint64        `json:"quota"`
+	Cost        uint64        `json:"cost"`
+	Concurrent  uint32        `json:"concurrent"`
+	Count       uint64        `json:"count"`
+	FetchTime   time.Time     `json:"fetchTime"`
+	TTL         time.Duration `json:"ttl"`   // negative means the default ttl of the file type, 0 disables the cache
+	Large       bool          `json:"large"` // the body is not in memory, it's on the disk or streamed from the backend
+	Size        int64         `json:"size"`
+	DiskPath    string        `json:"-"`
+	CachePolicy *cachePolicy  `json:"cachePolicy"` // overrides the policy table
+	Vary        []string      `json:"vary"`        // the request headers to select the variant of the file
 	dependents  *dependentSet
+
+	restored     int32 // 1 if the file is loaded from db and not checked against the backend yet
+	stale        int32 // 1 if the last revalidation of the file failed
+	revalidating int32
+
+	err error // the backend error of the file
 }
 
 // FileType ...
@@ -84,8 +101,13 @@ const (
 	fileTypeOverload = 5
 	fileTypeNotFound = 6
 
-	eTag        = "ETag"
-	ifNoneMatch = "If-None-Match"
+	eTag              = "ETag"
+	ifNoneMatch       = "If-None-Match"
+	ifModifiedSince   = "If-Modified-Since"
+	ifUnmodifiedSince = "If-Unmodified-Since"
+	lastModified      = "Last-Modified"
+
+	staleAgeHeader = "Portm-Stale-Age"
 )
 
 type dependentSet struct {
@@ -98,6 +120,16 @@ var overloadFile = &File{
 	Body: []byte(http.StatusText(statusTooManyRequests)),
 }
 
+// the placeholder of the file when the backend failed, it expires as a negative answer
+func newErrorFile(msg string, err error) *File {
+	return &File{
+		Body:      []byte(msg),
+		FetchTime: time.Now(),
+		TTL:       -1,
+		err:       err,
+	}
+}
+
 func newDependentSet() *dependentSet {
 	return &dependentSet{
 		dict: map[*File]bool{},
@@ -143,11 +175,141 @@ func (dp *dependentSet) List() []*File {
 	return list
 }
 
+// only keep the compressed body when it's smaller
+func shrunk(body []byte, compressed []byte) []byte {
+	if len(compressed) < len(body) {
+		return compressed
+	}
+	return nil
+}
+
+// the available content encodings of the file, in the preferred order
+func (f *File) encodings() []string {
+	list := []string{}
+	if f.BrotliBody != nil {
+		list = append(list, encodingBrotli)
+	}
+	if f.ZstdBody != nil {
+		list = append(list, encodingZstd)
+	}
+	if f.GzippedBody != nil {
+		list = append(list, gzip)
+	}
+	return list
+}
+
+func (f *File) encodedBody(encoding string) []byte {
+	switch encoding {
+	case encodingBrotli:
+		return f.BrotliBody
+	case encodingZstd:
+		return f.ZstdBody
+	case gzip:
+		return f.GzippedBody
+	default:
+		return f.Body
+	}
+}
+
+// the value of the header passed through from the backend
+func (f *File) header(key string) string {
+	for i := 0; i < len(f.Headers)-1; i += 2 {
+		if string(f.Headers[i]) == key {
+			return string(f.Headers[i+1])
+		}
+	}
+	return ""
+}
+
+// parse the seconds of the ttl header, -1 if it's not a valid number
+func parseTTL(value string) time.Duration {
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parse the http date or the RFC3339 time, zero if it's not parsable
+func parseTime(value string) time.Time {
+	if t, err := http.ParseTime(value); err == nil {
+		return t
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// the Last-Modified of the backend, or the Portm-Modify-Time, zero if neither is parsable
+func (f *File) modifiedTime() time.Time {
+	t := parseTime(f.header(lastModified))
+	if t.IsZero() {
+		t = parseTime(f.ModifyTime)
+	}
+	return t
+}
+
+// the conditional headers to revalidate the file against the backend
+func (f *File) validators() http.Header {
+	header := http.Header{}
+
+	if etag := f.header("Etag"); etag != "" {
+		header.Set(ifNoneMatch, etag)
+	} else if f.ID != "" {
+		header.Set(ifNoneMatch, f.ID)
+	}
+
+	if t := f.modifiedTime(); !t.IsZero() {
+		header.Set(ifModifiedSince, t.UTC().Format(http.TimeFormat))
+	}
+
+	return header
+}
+
+// whether the file is a response of the backend, not a placeholder of the failure or the overload
+func (f *File) fetched() bool {
+	return !f.FetchTime.IsZero() && f.err == nil
+}
+
+// the copy of the file with a new lifetime, used when the backend responds 304,
+// the compressed bodies and the parsed code are kept
+func (f *File) renewed() *File {
+	file := *f
+	file.Count = atomic.LoadUint64(&f.Count)
+	file.Cost = atomic.LoadUint64(&f.Cost)
+	file.FetchTime = time.Now()
+	file.restored = 0
+	file.stale = 0
+	file.revalidating = 0
+	return &file
+}
+
 func isTextFile(fileType FileType) bool {
 	return fileType == fileTypeJSON || fileType == fileTypeText
 }
 
-// header should contain the const variable above
+// precompute the compressed bodies, the min sizes and the zstd of the config decide which ones
+func (f *File) encode(conf *Config) {
+	body := f.Body
+	textMIME := f.Type == fileTypeBinary && utils.IsTextMIME(f.ContentType)
+
+	if len(body) > conf.GzipMinSize && isTextFile(f.Type) || textMIME {
+		f.GzippedBody = utils.Gzip(body)
+	}
+
+	if isTextFile(f.Type) || textMIME {
+		if len(body) > conf.BrotliMinSize {
+			f.BrotliBody = shrunk(body, utils.Brotli(body))
+		}
+
+		if conf.Zstd && len(body) > conf.ZstdMinSize {
+			f.ZstdBody = shrunk(body, utils.Zstd(body))
+		}
+	}
+}
+
+// header should contain the const variable above, the bodies are encoded by the encode
 func newFile(uri string, header map[string]string, body []byte) *File {
 	headers := make([][]byte, 0)
 	var gisp interface{}
@@ -158,7 +320,9 @@ func newFile(uri string, header map[string]string, body []byte) *File {
 	var rootID string
 	var modifyTime string
 	var contentType string
-	var gzippedBody []byte
+	ttl, negativeTTL := time.Duration(-1), time.Duration(-1)
+	var policy *cachePolicy
+	var vary []string
 	quota := maxQuota
 	concurrent := maxConcurrent
 
@@ -182,6 +346,19 @@ func newFile(uri string, header map[string]string, body []byte) *File {
 		case "Portm-Modify-Time":
 			modifyTime = v
 			continue
+		// the net/http canonicalizes them to the Ttl
+		case "Portm-Cache-TTL", "Portm-Cache-Ttl":
+			ttl = parseTTL(v)
+			continue
+		case "Portm-Negative-TTL", "Portm-Negative-Ttl":
+			negativeTTL = parseTTL(v)
+			continue
+		case "Portm-Cache-Control", "Portm-Expires", "Portm-Surrogate-Control":
+			policy = parseFilePolicy(policy, k, v)
+			continue
+		case "Portm-Vary":
+			vary = parseVary(v)
+			continue
 		case "Portm-Type":
 			switch v {
 			case "Json":
@@ -226,18 +403,14 @@ func newFile(uri string, header map[string]string, body []byte) *File {
 		headers = append(headers, []byte(k), []byte(v))
 	}
 
-	if len(body) > gzipMinSize && isTextFile(fileType) {
-		gzippedBody = utils.Gzip(body)
-	}
-
-	if fileType == fileTypeBinary && utils.IsTextMIME(contentType) {
-		gzippedBody = utils.Gzip(body)
-	}
-
 	if gisp == nil && body != nil {
 		etag = utils.ETag(body)
 	}
 
+	if fileType == fileTypeNotFound {
+		ttl = negativeTTL
+	}
+
 	return &File{
 		Type:        fileType,
 		ModifierID:  modifierID,
@@ -250,11 +423,14 @@ func newFile(uri string, header map[string]string, body []byte) *File {
 		Body:        body,
 		ETag:        etag,
 		Count:       1,
-		GzippedBody: gzippedBody,
 		ContentType: contentType,
 		dependents:  newDependentSet(),
 		Quota:       quota,
 		Cost:        0,
 		Concurrent:  uint32(concurrent),
+		FetchTime:   time.Now(),
+		TTL:         ttl,
+		CachePolicy: policy,
+		Vary:        vary,
 	}
 }
@@ -14,6 +14,7 @@ type globCache struct {
 	overload  int32
 	descCache *umi.Cache
 	ascCache  *umi.Cache
+	stats     hitCounter
 }
 
 type matchInfo struct {
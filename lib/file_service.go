@@ -2,7 +2,10 @@ package lib
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -24,12 +27,15 @@ const (
 	statusNotModified      = 304
 	statusForbiden         = 403
 	statusNotFound         = 404
+	statusPreconditionFail = 412
 	statusTooManyRequests  = 429
 	statusScriptError      = 500
 	statusPassThroughCache = 600
 
-	gzipMinSize = 256
-	gzip        = "gzip"
+	gzip = "gzip"
+
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
 )
 
 func (appCtx *AppContext) getFileFromCache(uri string) (file *File) {
@@ -38,6 +44,10 @@ func (appCtx *AppContext) getFileFromCache(uri string) (file *File) {
 	if exists {
 		file = cache.(*File)
 		atomic.AddUint64(&file.Count, 1)
+
+		if atomic.LoadInt32(&file.restored) == 1 && !appCtx.isExpired(file) {
+			appCtx.revalidateAsync(uri, file)
+		}
 	} else {
 		file = nil
 	}
@@ -45,88 +55,180 @@ func (appCtx *AppContext) getFileFromCache(uri string) (file *File) {
 	return
 }
 
-func (appCtx *AppContext) requestFile(uri string) *File {
-	res, err := http.Get((&url.URL{
-		Scheme:   "http",
-		Host:     appCtx.fileServiceAddr,
-		Path:     "/api/file",
-		RawQuery: fmt.Sprintf("uri=%s", url.QueryEscape(uri)),
-	}).String())
+func (appCtx *AppContext) setFile(uri string, file *File) {
+	old, has := appCtx.cache.Peek(uri)
+
+	appCtx.cache.Set(uri, file)
+	appCtx.fileStore.save(uri, file)
+
+	if has {
+		appCtx.removeDiskFile(old.(*File), file)
+	}
+}
+
+// the uri could be a variant key
+func (appCtx *AppContext) delFile(uri string) {
+	old, has := appCtx.cache.Peek(uri)
+
+	appCtx.cache.Del(uri)
+	appCtx.fileStore.del(uri)
+
+	if has {
+		appCtx.removeDiskFile(old.(*File), nil)
+	}
+}
+
+// The uri could be a variant key, its request headers will be sent to the backend.
+// The cached file is optional, if it's given the request will be conditional,
+// and the cached file will be renewed if the backend responds 304.
+func (appCtx *AppContext) requestFile(key string, cached *File) (*File, error) {
+	uri, header := parseVariantKey(key)
+	if header == nil {
+		header = http.Header{}
+	}
+
+	conditional := cached != nil && cached.fetched()
+	if conditional {
+		for k, v := range cached.validators() {
+			header[k] = v
+		}
+	}
+
+	res, err := appCtx.backends.get("/api/file", fmt.Sprintf("uri=%s", url.QueryEscape(uri)), header)
 
 	if err != nil {
 		fmt.Fprintln(os.Stderr, uri+" connect error:\n"+err.Error())
 		appCtx.overloadMointer.action <- &overloadMessage{
 			origin: overloadOriginFile,
-			uri:    uri,
-		}
-		return &File{
-			Body: []byte("file service error"),
+			uri:    key,
 		}
+		return newErrorFile("file service error", err), err
 	}
 
 	defer res.Body.Close()
 
-	body, err := ioutil.ReadAll(res.Body)
+	if conditional && res.StatusCode == statusNotModified {
+		return cached.renewed(), nil
+	}
+
+	// the large binary won't be held in memory
+	maxCachedBody := int64(appCtx.conf().MaxCacheableSize)
+	var bodyReader io.Reader = res.Body
+	mayBeLarge := res.StatusCode == 200 &&
+		maxCachedBody > 0 &&
+		res.Header.Get("Portm-Type") == "Binary"
+	if mayBeLarge {
+		if res.ContentLength > maxCachedBody {
+			bodyReader = &bytes.Buffer{}
+		} else {
+			bodyReader = io.LimitReader(res.Body, maxCachedBody+1)
+		}
+	}
+
+	body, err := ioutil.ReadAll(bodyReader)
 
 	if err != nil {
 		fmt.Fprintln(os.Stderr, uri+" read error:\n"+err.Error())
 		appCtx.overloadMointer.action <- &overloadMessage{
 			origin: overloadOriginFile,
-			uri:    uri,
-		}
-		return &File{
-			Body: []byte("read file service error"),
+			uri:    key,
 		}
+		return newErrorFile("read file service error", err), err
 	}
 
 	if res.StatusCode != 200 {
 		fmt.Fprintln(os.Stderr, uri+":"+strconv.Itoa(res.StatusCode)+"\n"+string(body))
 		appCtx.overloadMointer.action <- &overloadMessage{
 			origin: overloadOriginFile,
-			uri:    uri,
-		}
-		return &File{
-			Body: []byte("file service error"),
+			uri:    key,
 		}
+		err = errors.New("file service status code " + strconv.Itoa(res.StatusCode))
+		return newErrorFile("file service error", err), err
 	}
 
-	header := map[string]string{}
+	resHeader := map[string]string{}
 	for k, v := range res.Header {
-		header[k] = v[0]
+		resHeader[k] = v[0]
+	}
+
+	if mayBeLarge && (res.ContentLength > maxCachedBody || int64(len(body)) > maxCachedBody) {
+		// the variants are spilled to their own disk files
+		file := appCtx.newLargeFile(key, resHeader, res.ContentLength, io.MultiReader(bytes.NewReader(body), res.Body))
+		file.URI = uri
+		return file, nil
 	}
 
-	return newFile(uri, header, body)
+	file := newFile(uri, resHeader, body)
+	file.encode(appCtx.conf())
+	return file, nil
 }
 
-func (appCtx *AppContext) getFile(uri string) (file *File) {
+func (appCtx *AppContext) getFile(uri string) *File {
+	file, _ := appCtx.lookupFile(uri)
+	return file
+}
+
+// the same as the getFile, but also returns the cache status of the file
+func (appCtx *AppContext) lookupFile(uri string) (file *File, cacheStatus string) {
 	uri, _ = utils.GetURIPath(uri)
+	defer func() {
+		appCtx.warmup.record(uri, file)
+	}()
+
 	file = appCtx.getFileFromCache(uri)
 	if file != nil {
-		return
+		if !appCtx.isExpired(file) {
+			return file, cacheHit
+		}
+
+		if appCtx.canServeStale(file) {
+			appCtx.revalidateAsync(uri, file)
+			return file, cacheStale
+		}
 	}
 
 	atomic.AddInt32(&appCtx.workingCount, 1)
 	defer atomic.AddInt32(&appCtx.workingCount, -1)
 
-	if appCtx.workingCount > appCtx.overload {
-		return overloadFile
+	if atomic.LoadInt32(&appCtx.workingCount) > atomic.LoadInt32(&appCtx.overload) {
+		return overloadFile, cacheOverload
 	}
 
-	appCtx.workingLock.Lock()
-	defer appCtx.workingLock.Unlock()
+	return appCtx.fetchFile(uri), cacheMiss
+}
 
-	file = appCtx.getFileFromCache(uri)
-	if file != nil {
-		return
-	}
+// the concurrent fetches of the same uri share one request
+func (appCtx *AppContext) fetchFile(uri string) *File {
+	value, err := appCtx.fetching.Do(uri, func() interface{} {
+		file := appCtx.getFileFromCache(uri)
+		if file != nil && !appCtx.isExpired(file) {
+			return file
+		}
 
-	appCtx.reqCount.chStatusCode <- statusPassThroughCache
+		appCtx.reqCount.chStatusCode <- statusPassThroughCache
 
-	file = appCtx.requestFile(uri)
+		newFile, err := appCtx.requestFile(uri, file)
 
-	appCtx.cache.Set(uri, file)
+		// the last good copy won't be replaced by the error placeholder
+		if err != nil && file != nil && appCtx.canServeStale(file) && appCtx.keepStale(uri) {
+			return file
+		}
 
-	return
+		if file != nil {
+			appCtx.markChecked(file, fileChanged(file, newFile))
+		}
+
+		appCtx.setFile(uri, newFile)
+
+		return newFile
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, uri+" fetch error:\n"+err.Error())
+		return newErrorFile("fetch file error", err)
+	}
+
+	return value.(*File)
 }
 
 var cleanURIReg = regexp.MustCompile(`\bquery\.[^.=]+=[^\&]*`)
@@ -159,6 +261,7 @@ func (appCtx *AppContext) handleProxy(uri string, ctx *fasthttp.RequestCtx) {
 		timer := uint64(time.Now().UnixNano() - startTime)
 
 		atomic.AddUint64(&file.Cost, timer)
+		ctx.SetUserValue(gispCostKey, timer)
 
 		appCtx.cost.chAdd <- &costMessage{
 			uri:  file.URI,
@@ -195,7 +298,14 @@ func (appCtx *AppContext) handleProxy(uri string, ctx *fasthttp.RequestCtx) {
 }
 
 func (appCtx *AppContext) handleFile(uri string, ctx *fasthttp.RequestCtx) {
-	file := appCtx.getFile(uri)
+	file, cacheStatus := appCtx.lookupFile(uri)
+
+	if file != nil && len(file.Vary) > 0 && file.err == nil {
+		file, cacheStatus = appCtx.getVariant(uri, file, cacheStatus, ctx)
+	}
+
+	ctx.SetUserValue(cacheStatusKey, cacheStatus)
+	appCtx.fileStats.record(cacheStatus)
 
 	if file == nil {
 		appCtx.reqCount.chStatusCode <- statusNotFound
@@ -215,11 +325,24 @@ func (appCtx *AppContext) handleFile(uri string, ctx *fasthttp.RequestCtx) {
 	}
 
 	// Set headers
-	// it could be overwrite by gisp
+	// it could be overwrite by gisp, the error placeholder has no cache policy
+	if file.err == nil {
+		defer clearCachePolicy(ctx, appCtx.setCachePolicy(ctx, file))
+	}
 	appCtx.setHeaders(ctx, file)
 
+	if len(file.Vary) > 0 {
+		ctx.Response.Header.Set("Vary", strings.Join(file.Vary, ", "))
+	}
+
+	appCtx.setStaleAge(ctx, file)
+
 	var body []byte
 	if file.Code == nil {
+		if appCtx.handleDateValidators(ctx, file.modifiedTime()) {
+			return
+		}
+
 		// Check ETag
 		if file.ETag != nil && bytes.Equal(
 			ctx.Request.Header.Peek(ifNoneMatch), file.ETag,
@@ -234,12 +357,28 @@ func (appCtx *AppContext) handleFile(uri string, ctx *fasthttp.RequestCtx) {
 			file.ETag,
 		)
 
-		if file.GzippedBody != nil && ctx.Request.Header.HasAcceptEncodingBytes([]byte(gzip)) {
-			ctx.Response.Header.SetBytesKV([]byte("Content-Encoding"), []byte(gzip))
-			body = file.GzippedBody
-		} else {
-			body = file.Body
+		if file.Large {
+			appCtx.handleLargeFile(ctx, file)
+			appCtx.reqCount.chStatusCode <- ctx.Response.StatusCode()
+			return
+		}
+
+		if file.Type == fileTypeBinary && appCtx.handleRange(ctx, file) {
+			appCtx.reqCount.chStatusCode <- ctx.Response.StatusCode()
+			return
 		}
+
+		encodings := file.encodings()
+		if len(encodings) > 0 {
+			vary := append(append([]string{}, file.Vary...), "Accept-Encoding")
+			ctx.Response.Header.Set("Vary", strings.Join(vary, ", "))
+		}
+
+		encoding := utils.NegotiateEncoding(string(ctx.Request.Header.Peek("Accept-Encoding")), encodings)
+		if encoding != "" {
+			ctx.Response.Header.Set("Content-Encoding", encoding)
+		}
+		body = file.encodedBody(encoding)
 	} else {
 		startTime := time.Now().UnixNano()
 		if appCtx.cost.many(file.URI, file.Quota, file.Concurrent) {
@@ -249,11 +388,13 @@ func (appCtx *AppContext) handleFile(uri string, ctx *fasthttp.RequestCtx) {
 			return
 		}
 
+		var env *gispEnv
 		var err interface{}
-		body, _, err = appCtx.runGisp(file, ctx, false)
+		body, env, err = appCtx.runGisp(file, ctx, false)
 
 		timer := uint64(time.Now().UnixNano() - startTime)
 		atomic.AddUint64(&file.Cost, timer)
+		ctx.SetUserValue(gispCostKey, timer)
 
 		appCtx.cost.chAdd <- &costMessage{
 			uri:  file.URI,
@@ -268,6 +409,11 @@ func (appCtx *AppContext) handleFile(uri string, ctx *fasthttp.RequestCtx) {
 			return
 		}
 
+		// the redirects and the other statuses set by the script are kept as they are
+		if ctx.Response.StatusCode() == 200 && appCtx.handleDateValidators(ctx, env.lastModified) {
+			return
+		}
+
 		// Check ETag
 		if body != nil {
 			etag := utils.ETag(body)
@@ -289,26 +435,74 @@ func (appCtx *AppContext) handleFile(uri string, ctx *fasthttp.RequestCtx) {
 	appCtx.reqCount.chStatusCode <- ctx.Response.StatusCode()
 }
 
+// Set the Last-Modified header, and check the If-Unmodified-Since and If-Modified-Since headers.
+// Returns true if the response has been written.
+func (appCtx *AppContext) handleDateValidators(ctx *fasthttp.RequestCtx, modTime time.Time) bool {
+	if modTime.IsZero() {
+		return false
+	}
+
+	// the http date only has the precision of second
+	modTime = modTime.Truncate(time.Second)
+
+	ctx.Response.Header.Set(lastModified, modTime.UTC().Format(http.TimeFormat))
+
+	if t, err := fasthttp.ParseHTTPDate(ctx.Request.Header.Peek(ifUnmodifiedSince)); err == nil && modTime.After(t) {
+		appCtx.reqCount.chStatusCode <- statusPreconditionFail
+		ctx.SetStatusCode(statusPreconditionFail)
+		return true
+	}
+
+	// the If-None-Match takes precedence over the If-Modified-Since
+	if ctx.Request.Header.Peek(ifNoneMatch) != nil || !(ctx.IsGet() || ctx.IsHead()) {
+		return false
+	}
+
+	if t, err := fasthttp.ParseHTTPDate(ctx.Request.Header.Peek(ifModifiedSince)); err == nil && !modTime.After(t) {
+		appCtx.reqCount.chStatusCode <- statusNotModified
+		ctx.NotModified()
+		return true
+	}
+
+	return false
+}
+
 // FileService ...
 func (appCtx *AppContext) FileService() func() {
+	appCtx.restoreFiles()
+
 	listener, _ := net.Listen("tcp", appCtx.addr)
 
 	server := &fasthttp.Server{
 		ReadBufferSize: 1024 * 8,
 		Handler: func(ctx *fasthttp.RequestCtx) {
+			defer appCtx.track()()
+
+			defer appCtx.logAccess(ctx, time.Now())
+
 			ctx.Response.Header.DisableNormalizing()
 
+			// let the keep-alive clients reconnect to the other nodes
+			if appCtx.isDraining() {
+				ctx.SetConnectionClose()
+			}
+
+			if appCtx.redirectHTTPS(ctx) {
+				return
+			}
+			appCtx.setHSTS(ctx)
+
+			// the scheme depends on which listener the request comes from
+			scheme := "http"
+			if ctx.IsTLS() {
+				scheme = "https"
+			}
+
 			uri := ctx.URI()
-			uriStr := string(uri.Scheme()) + "://" + string(uri.Host()) + string(uri.Path())
-
-			if len(appCtx.blacklist[0]) != 0 {
-				for _, prefix := range appCtx.blacklist {
-					if strings.HasPrefix(uriStr, prefix) {
-						ctx.SetStatusCode(statusTooManyRequests)
-						ctx.WriteString(`"Forbidden"`)
-						return
-					}
-				}
+			uriStr := scheme + "://" + string(uri.Host()) + string(uri.Path())
+
+			if !appCtx.checkAccess(ctx, uriStr) || !appCtx.checkRateLimit(ctx) {
+				return
 			}
 
 			appCtx.handleProxy(uriStr, ctx)
@@ -319,7 +513,25 @@ func (appCtx *AppContext) FileService() func() {
 
 	fmt.Printf("file service listen on %s\n", appCtx.addr)
 
+	if appCtx.tlsAddr == "" {
+		return func() {
+			listener.Close()
+		}
+	}
+
+	tlsListener, err := net.Listen("tcp", appCtx.tlsAddr)
+	if err != nil {
+		panic(err)
+	}
+
+	go server.Serve(tls.NewListener(tlsListener, &tls.Config{
+		GetCertificate: appCtx.certs.get,
+	}))
+
+	fmt.Printf("file service listen on %s with tls\n", appCtx.tlsAddr)
+
 	return func() {
 		listener.Close()
+		tlsListener.Close()
 	}
 }
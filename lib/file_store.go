@@ -0,0 +1,294 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const fileStorePrefix = "file:"
+
+type fileStore struct {
+	chAction chan *fileStoreMessage
+	maxAge   time.Duration
+	stopped  int32
+
+	restoredCount   int32
+	pendingCount    int32
+	changedCount    int32
+	droppedCount    int32
+	restoredTime    time.Time
+	restoredMaxAge  time.Duration
+	restoredMinAge  time.Duration
+	restoredSumAges time.Duration
+}
+
+type fileStoreMessage struct {
+	uri   string
+	file  *File
+	purge bool
+	done  chan bool // the worker stops after the writes before it
+}
+
+// the persisted form of a File, the fields with "-" json tag of File are kept too
+type fileRecord struct {
+	ID          string      `json:"id"`
+	URI         string      `json:"uri"`
+	Type        int         `json:"type"`
+	ModifierID  string      `json:"modifierId"`
+	RootID      string      `json:"rootId"`
+	ModifyTime  string      `json:"modifyTime"`
+	Headers     [][]byte    `json:"headers"`
+	ETag        []byte      `json:"etag"`
+	Body        []byte      `json:"body"`
+	GzippedBody []byte      `json:"gzippedBody"`
+	BrotliBody  []byte      `json:"brotliBody"`
+	ZstdBody    []byte      `json:"zstdBody"`
+	Code        interface{} `json:"code"`
+	ContentType string      `json:"contentType"`
+	Quota       uint64      `json:"quota"`
+	Concurrent  uint32      `json:"concurrent"`
+	FetchTime   time.Time   `json:"fetchTime"`
+	TTL         int64       `json:"ttl"`
+	Large       bool        `json:"large"`
+	Size        int64       `json:"size"`
+	DiskPath    string      `json:"diskPath"`
+
+	CachePolicy *cachePolicy `json:"cachePolicy"`
+	Vary        []string     `json:"vary"`
+}
+
+// maxAge 0 disables the persistence
+func newFileStore(maxAge time.Duration) *fileStore {
+	store := &fileStore{
+		chAction: make(chan *fileStoreMessage, 10000),
+		maxAge:   maxAge,
+	}
+
+	go store.worker()
+
+	return store
+}
+
+func (store *fileStore) enabled() bool {
+	return store.maxAge > 0 && atomic.LoadInt32(&store.stopped) == 0
+}
+
+func (store *fileStore) worker() {
+	for msg := range store.chAction {
+		if msg.done != nil {
+			msg.done <- true
+			return
+		}
+
+		if msg.purge {
+			store.purgeDb()
+			continue
+		}
+
+		key := []byte(fileStorePrefix + msg.uri)
+
+		if msg.file == nil {
+			db.Delete(key, nil)
+			continue
+		}
+
+		data, err := json.Marshal(toFileRecord(msg.file))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fileStore:", msg.uri, err.Error())
+			continue
+		}
+
+		db.Put(key, data, nil)
+	}
+}
+
+func (store *fileStore) save(uri string, file *File) {
+	if !store.enabled() || file.Type == fileTypeOverload || file.err != nil {
+		return
+	}
+
+	store.chAction <- &fileStoreMessage{uri: uri, file: file}
+}
+
+func (store *fileStore) del(uri string) {
+	if !store.enabled() {
+		return
+	}
+
+	store.chAction <- &fileStoreMessage{uri: uri}
+}
+
+func (store *fileStore) purge() {
+	if !store.enabled() {
+		return
+	}
+
+	store.chAction <- &fileStoreMessage{purge: true}
+}
+
+// Stop the new writes and wait for the queued ones to be written, so that the db can be closed.
+func (store *fileStore) stop(timeout time.Duration) error {
+	if !store.enabled() {
+		return nil
+	}
+	atomic.StoreInt32(&store.stopped, 1)
+
+	done := make(chan bool, 1)
+
+	select {
+	case store.chAction <- &fileStoreMessage{done: done}:
+	case <-time.After(timeout):
+		return errors.New("file store flush timeout")
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("file store flush timeout")
+	}
+}
+
+func (store *fileStore) purgeDb() {
+	iter := db.NewIterator(util.BytesPrefix([]byte(fileStorePrefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		db.Delete(iter.Key(), nil)
+	}
+}
+
+// load all the persisted files, the expired ones will be removed from the db
+func (store *fileStore) load(fn func(uri string, file *File)) {
+	if !store.enabled() {
+		return
+	}
+
+	iter := db.NewIterator(util.BytesPrefix([]byte(fileStorePrefix)), nil)
+	defer iter.Release()
+
+	now := time.Now()
+
+	for iter.Next() {
+		var record fileRecord
+
+		err := json.Unmarshal(iter.Value(), &record)
+		age := now.Sub(record.FetchTime)
+
+		if err != nil || age > store.maxAge {
+			db.Delete(iter.Key(), nil)
+			store.droppedCount++
+			continue
+		}
+
+		uri := string(iter.Key()[len(fileStorePrefix):])
+		fn(uri, record.toFile())
+
+		if store.restoredCount == 0 || age > store.restoredMaxAge {
+			store.restoredMaxAge = age
+		}
+		if store.restoredCount == 0 || age < store.restoredMinAge {
+			store.restoredMinAge = age
+		}
+		store.restoredSumAges += age
+		store.restoredCount++
+	}
+
+	store.pendingCount = store.restoredCount
+	store.restoredTime = now
+
+	fmt.Println("file cache restored:", store.restoredCount, "dropped:", store.droppedCount)
+}
+
+// the restored file has been checked against the backend
+func (store *fileStore) checked(changed bool) {
+	atomic.AddInt32(&store.pendingCount, -1)
+
+	if changed {
+		atomic.AddInt32(&store.changedCount, 1)
+	}
+}
+
+func (store *fileStore) status() map[string]interface{} {
+	avgAge := time.Duration(0)
+	if store.restoredCount > 0 {
+		avgAge = store.restoredSumAges / time.Duration(store.restoredCount)
+	}
+
+	return map[string]interface{}{
+		"enabled":  store.enabled(),
+		"restored": store.restoredCount,
+		"pending":  atomic.LoadInt32(&store.pendingCount),
+		"changed":  atomic.LoadInt32(&store.changedCount),
+		"dropped":  store.droppedCount,
+		"time":     store.restoredTime.UnixNano() / 1000 / 1000,
+		"minAge":   store.restoredMinAge.Nanoseconds() / 1000 / 1000,
+		"maxAge":   store.restoredMaxAge.Nanoseconds() / 1000 / 1000,
+		"avgAge":   avgAge.Nanoseconds() / 1000 / 1000,
+	}
+}
+
+func toFileRecord(file *File) *fileRecord {
+	return &fileRecord{
+		ID:          file.ID,
+		URI:         file.URI,
+		Type:        int(file.Type),
+		ModifierID:  file.ModifierID,
+		RootID:      file.RootID,
+		ModifyTime:  file.ModifyTime,
+		Headers:     file.Headers,
+		ETag:        file.ETag,
+		Body:        file.Body,
+		GzippedBody: file.GzippedBody,
+		BrotliBody:  file.BrotliBody,
+		ZstdBody:    file.ZstdBody,
+		Code:        file.Code,
+		ContentType: file.ContentType,
+		Quota:       file.Quota,
+		Concurrent:  file.Concurrent,
+		FetchTime:   file.FetchTime,
+		TTL:         int64(file.TTL),
+		Large:       file.Large,
+		Size:        file.Size,
+		DiskPath:    file.DiskPath,
+		CachePolicy: file.CachePolicy,
+		Vary:        file.Vary,
+	}
+}
+
+func (record *fileRecord) toFile() *File {
+	return &File{
+		ID:          record.ID,
+		URI:         record.URI,
+		Type:        FileType(record.Type),
+		ModifierID:  record.ModifierID,
+		RootID:      record.RootID,
+		ModifyTime:  record.ModifyTime,
+		Headers:     record.Headers,
+		ETag:        record.ETag,
+		Body:        record.Body,
+		GzippedBody: record.GzippedBody,
+		BrotliBody:  record.BrotliBody,
+		ZstdBody:    record.ZstdBody,
+		Code:        record.Code,
+		ContentType: record.ContentType,
+		Quota:       record.Quota,
+		Concurrent:  record.Concurrent,
+		Count:       0,
+		FetchTime:   record.FetchTime,
+		TTL:         time.Duration(record.TTL),
+		Large:       record.Large,
+		Size:        record.Size,
+		DiskPath:    record.DiskPath,
+		CachePolicy: record.CachePolicy,
+		Vary:        record.Vary,
+		dependents:  newDependentSet(),
+		restored:    1,
+	}
+}
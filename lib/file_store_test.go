@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// open a temporary db for the test, the returned function closes and removes it
+func openTestDb(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "portal-db")
+	assert.Nil(t, err)
+
+	initDb(dir)
+
+	return func() {
+		CloseDb()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	defer openTestDb(t)()
+
+	store := &fileStore{chAction: make(chan *fileStoreMessage, 10), maxAge: time.Hour}
+
+	fetchTime := time.Now().Add(-time.Minute)
+	file := newFile("a.com/b", map[string]string{"Portm-Id": "1", "Portm-Type": "Text"}, []byte("ok"))
+	file.FetchTime = fetchTime
+	file.TTL = 30 * time.Second
+
+	old := newFile("a.com/old", map[string]string{"Portm-Type": "Text"}, []byte("old"))
+	old.FetchTime = time.Now().Add(-2 * time.Hour)
+
+	store.save("a.com/b", file)
+	store.save("a.com/old", old)
+	close(store.chAction)
+	store.worker()
+
+	files := map[string]*File{}
+	store.load(func(uri string, f *File) {
+		files[uri] = f
+	})
+
+	assert.Len(t, files, 1)
+	restored := files["a.com/b"]
+	assert.True(t, fetchTime.Equal(restored.FetchTime))
+	assert.Equal(t, 30*time.Second, restored.TTL)
+	assert.Equal(t, "ok", string(restored.Body))
+	assert.Equal(t, int32(1), restored.restored)
+
+	_, err := db.Get([]byte(fileStorePrefix+"a.com/old"), nil)
+	assert.NotNil(t, err)
+
+	appCtx := &AppContext{fileStore: store}
+	appCtx.markChecked(restored, true)
+	appCtx.markChecked(restored, true)
+	assert.Equal(t, int32(0), restored.restored)
+
+	ctx := &fasthttp.RequestCtx{}
+	appCtx.restoreStatus(ctx)
+
+	status := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &status))
+	assert.Equal(t, float64(1), status["restored"])
+	assert.Equal(t, float64(0), status["pending"])
+	assert.Equal(t, float64(1), status["changed"])
+	assert.Equal(t, float64(1), status["dropped"])
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileValidators(t *testing.T) {
+	file := newFile("a.com/b", map[string]string{
+		"Portm-Id":          "10",
+		"Portm-Modify-Time": "2018-01-02T03:04:05Z",
+		"Portm-Type":        "Text",
+	}, []byte("ok"))
+
+	header := file.validators()
+	assert.Equal(t, "10", header.Get(ifNoneMatch))
+	assert.Equal(t, "Tue, 02 Jan 2018 03:04:05 GMT", header.Get(ifModifiedSince))
+
+	file = newFile("a.com/b", map[string]string{
+		"Etag":          `"abc"`,
+		"Last-Modified": "Mon, 01 Jan 2018 00:00:00 GMT",
+	}, []byte("ok"))
+
+	header = file.validators()
+	assert.Equal(t, `"abc"`, header.Get(ifNoneMatch))
+	assert.Equal(t, "Mon, 01 Jan 2018 00:00:00 GMT", header.Get(ifModifiedSince))
+
+	// the placeholder files have nothing to validate
+	assert.Equal(t, http.Header{}, (&File{}).validators())
+}
+
+func TestFileRenewed(t *testing.T) {
+	file := newFile("a.com/b", map[string]string{"Portm-Type": "Text"}, []byte("ok"))
+	file.FetchTime = time.Now().Add(-time.Hour)
+	file.stale = 1
+	file.Count = 3
+
+	renewed := file.renewed()
+
+	assert.True(t, time.Since(renewed.FetchTime) < time.Minute)
+	assert.Equal(t, int32(0), renewed.stale)
+	assert.Equal(t, uint64(3), renewed.Count)
+	assert.Equal(t, file.ETag, renewed.ETag)
+}
+
+func TestFileTTL(t *testing.T) {
+	appCtx := testAppContext()
+
+	ttl := func(header map[string]string) time.Duration {
+		return appCtx.fileTTL(newFile("a.com/b", header, []byte("ok")))
+	}
+
+	assert.Equal(t, 60*time.Second, ttl(map[string]string{}))
+	assert.Equal(t, 60*time.Second, ttl(map[string]string{"Portm-Cache-TTL": "x"}))
+	assert.Equal(t, 30*time.Second, ttl(map[string]string{"Portm-Cache-TTL": "30"}))
+	assert.Equal(t, time.Duration(0), ttl(map[string]string{"Portm-Cache-TTL": "0"}))
+	assert.Equal(t, 120*time.Second, ttl(map[string]string{"Portm-Cache-TTL": "3600"}))
+
+	assert.Equal(t, 10*time.Second, ttl(map[string]string{"Portm-Not-Found": "1"}))
+	assert.Equal(t, 5*time.Second, ttl(map[string]string{"Portm-Not-Found": "1", "Portm-Negative-TTL": "5"}))
+	assert.Equal(t, 120*time.Second, ttl(map[string]string{"Portm-Not-Found": "1", "Portm-Negative-TTL": "3600"}))
+
+	assert.Equal(t, 10*time.Second, appCtx.fileTTL(newErrorFile("error", errBadAction)))
+}
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	assert.True(t, expected.Equal(parseTime("Tue, 02 Jan 2018 03:04:05 GMT")))
+	assert.True(t, expected.Equal(parseTime("2018-01-02T03:04:05Z")))
+	assert.True(t, parseTime("").IsZero())
+}
+
+func TestFileEncode(t *testing.T) {
+	encode := func(conf *Config, body string) *File {
+		file := newFile("a.com/b", map[string]string{"Portm-Type": "Text"}, []byte(body))
+		file.encode(conf)
+		return file
+	}
+
+	body := strings.Repeat("ok", 1024)
+
+	file := encode(&Config{GzipMinSize: 16}, body)
+	assert.NotNil(t, file.GzippedBody)
+	assert.NotNil(t, file.BrotliBody)
+	assert.Nil(t, file.ZstdBody)
+
+	file = encode(&Config{GzipMinSize: 4096, Zstd: true}, body)
+	assert.Nil(t, file.GzippedBody)
+	assert.NotNil(t, file.ZstdBody)
+
+	file = encode(&Config{GzipMinSize: 16, BrotliMinSize: 4096, Zstd: true, ZstdMinSize: 4096}, body)
+	assert.NotNil(t, file.GzippedBody)
+	assert.Nil(t, file.BrotliBody)
+	assert.Nil(t, file.ZstdBody)
+}
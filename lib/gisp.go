@@ -3,6 +3,7 @@ package lib
 import (
 	"bytes"
 	"encoding/json"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"github.com/ysmood/gisp"
@@ -19,15 +20,14 @@ type gispEnv struct {
 	proxyHost      string
 	proxyFile      string
 	fnRunCount     *int
+	lastModified   time.Time // set by the script for the Last-Modified header
 }
 
-const maxFnRunCount = 1e6
-
 func preRun(ctx *gisp.Context) {
 	env := ctx.ENV.(*gispEnv)
 	*env.fnRunCount++
 
-	if *env.fnRunCount > maxFnRunCount {
+	if *env.fnRunCount > env.appCtx.conf().MaxFnRunCount {
 		ctx.Error("max function run count exceeded")
 	}
 }
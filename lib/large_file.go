@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/portal/lib/utils"
+)
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+const (
+	streamHeaderTimeout = 10 * time.Second
+	streamIdleTimeout   = 30 * time.Second
+)
+
+// The large body can take long to stream, so only the wait of the response header
+// and the idle time between the reads are bounded.
+var streamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: streamHeaderTimeout}).DialContext,
+		ResponseHeaderTimeout: streamHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// idleReader closes the body if no read has returned for the timeout,
+// so that the stalled backend won't hold the handler
+type idleReader struct {
+	body  io.ReadCloser
+	timer *time.Timer
+	span  time.Duration
+}
+
+func newIdleReader(body io.ReadCloser, span time.Duration) *idleReader {
+	return &idleReader{
+		body:  body,
+		timer: time.AfterFunc(span, func() { body.Close() }),
+		span:  span,
+	}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.timer.Reset(r.span)
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// The file larger than the maxCacheableSize only keeps its meta data in the cache.
+// If the diskCacheDir is set the body will be spilled to the disk, else the body
+// will be streamed from the backend for every request.
+// The size is -1 if the backend doesn't tell the length of the streamed body.
+func (appCtx *AppContext) newLargeFile(uri string, header map[string]string, size int64, body io.Reader) *File {
+	if size < 0 {
+		size = -1
+	}
+
+	file := newFile(uri, header, nil)
+	file.Large = true
+	file.Size = size
+
+	if appCtx.diskCacheDir == "" {
+		return file
+	}
+
+	path, size, etag, err := appCtx.spill(uri, body)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, uri+" spill error:\n"+err.Error())
+		return file
+	}
+
+	file.DiskPath = path
+	file.Size = size
+	file.ETag = etag
+
+	return file
+}
+
+// the path is named by the hashes of the uri and the body, so that every version of the body has its own path
+func (appCtx *AppContext) diskPath(uri string, bodySum []byte) string {
+	sum := sha1.Sum([]byte(uri))
+	return filepath.Join(appCtx.diskCacheDir, hex.EncodeToString(sum[:])+"-"+hex.EncodeToString(bodySum))
+}
+
+// Write the body to a temp file then move it to the path of the body.
+// The cached file keeps its own path until it's replaced, so that its readers won't see another version.
+func (appCtx *AppContext) spill(uri string, body io.Reader) (path string, size int64, etag []byte, err error) {
+	tmp, err := ioutil.TempFile(appCtx.diskCacheDir, "tmp-")
+	if err != nil {
+		return
+	}
+
+	crc := crc32.NewIEEE()
+	hash := sha1.New()
+	size, err = io.Copy(io.MultiWriter(tmp, crc, hash), body)
+	tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	path = appCtx.diskPath(uri, hash.Sum(nil))
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	etag = utils.ETagOfSum(crc.Sum32())
+
+	return
+}
+
+// remove the disk file of the replaced file, the next file is nil if it's deleted,
+// the requests which have opened the disk file can still read it
+func (appCtx *AppContext) removeDiskFile(old *File, next *File) {
+	if old.DiskPath == "" || next != nil && next.DiskPath == old.DiskPath {
+		return
+	}
+
+	os.Remove(old.DiskPath)
+}
+
+func (appCtx *AppContext) purgeDiskCache() {
+	if appCtx.diskCacheDir == "" {
+		return
+	}
+
+	os.RemoveAll(appCtx.diskCacheDir)
+	os.MkdirAll(appCtx.diskCacheDir, 0755)
+}
+
+func (appCtx *AppContext) handleLargeFile(ctx *fasthttp.RequestCtx, file *File) {
+	if file.DiskPath != "" {
+		f, err := os.Open(file.DiskPath)
+
+		if err == nil {
+			appCtx.sendDiskFile(ctx, file, f)
+			return
+		}
+
+		fmt.Fprintln(os.Stderr, file.URI+" disk cache error:\n"+err.Error())
+	}
+
+	appCtx.streamFile(ctx, file)
+}
+
+func (appCtx *AppContext) sendDiskFile(ctx *fasthttp.RequestCtx, file *File, f *os.File) {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		ctx.Error("disk cache error", statusScriptError)
+		return
+	}
+
+	ctx.Response.Header.Set("Accept-Ranges", "bytes")
+
+	size := int(info.Size())
+	header := string(ctx.Request.Header.Peek("Range"))
+
+	if header != "" && ifRangeMatch(ctx.Request.Header.Peek("If-Range"), file) {
+		ranges, err := parseRange(header, size)
+
+		if err != nil {
+			f.Close()
+			ctx.Response.Header.Set("Content-Range", "bytes */"+strconv.Itoa(size))
+			ctx.SetStatusCode(statusRangeNotSatisfiable)
+			return
+		}
+
+		// only the single range is supported for the disk file
+		if len(ranges) == 1 {
+			r := ranges[0]
+			length := r.end - r.start + 1
+			ctx.SetStatusCode(statusPartialContent)
+			ctx.Response.Header.Set("Content-Range", r.contentRange(size))
+			ctx.SetBodyStream(&readCloser{io.NewSectionReader(f, int64(r.start), int64(length)), f}, length)
+			return
+		}
+	}
+
+	ctx.SetBodyStream(f, size)
+}
+
+// stream the body from the backend, the Range headers are passed through
+func (appCtx *AppContext) streamFile(ctx *fasthttp.RequestCtx, file *File) {
+	res, err := appCtx.backends.do(func(addr string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", (&url.URL{
+			Scheme:   "http",
+			Host:     addr,
+			Path:     "/api/file",
+			RawQuery: "uri=" + url.QueryEscape(file.URI),
+		}).String(), nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range append([]string{"Range", "If-Range"}, file.Vary...) {
+			if value := ctx.Request.Header.Peek(key); value != nil {
+				req.Header.Set(key, string(value))
+			}
+		}
+
+		return streamClient.Do(req)
+	})
+
+	if err != nil {
+		ctx.Error("file service error", 502)
+		return
+	}
+
+	for _, key := range []string{"Accept-Ranges", "Content-Range"} {
+		if value := res.Header.Get(key); value != "" {
+			ctx.Response.Header.Set(key, value)
+		}
+	}
+
+	ctx.SetStatusCode(res.StatusCode)
+	ctx.SetBodyStream(newIdleReader(res.Body, streamIdleTimeout), int(res.ContentLength))
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/umi"
+)
+
+func testLargeFileContext(t *testing.T) (*AppContext, func()) {
+	dir, err := ioutil.TempDir("", "portal-disk")
+	assert.Nil(t, err)
+
+	appCtx := testAppContext()
+	appCtx.conf().MaxCacheableSize = 8
+	appCtx.diskCacheDir = dir
+	appCtx.cache = umi.New(nil)
+	appCtx.fileStore = &fileStore{}
+
+	return appCtx, func() { os.RemoveAll(dir) }
+}
+
+func readDiskFile(path string) string {
+	data, _ := ioutil.ReadFile(path)
+	return string(data)
+}
+
+func TestLargeFileThreshold(t *testing.T) {
+	appCtx, clean := testLargeFileContext(t)
+	defer clean()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri := r.URL.Query().Get("uri")
+		w.Header().Set("Portm-Type", "Binary")
+
+		switch uri {
+		case "a.com/small":
+			w.Write([]byte("12345678"))
+		case "a.com/large":
+			w.Write([]byte("123456789"))
+		case "a.com/chunked":
+			// no Content-Length
+			w.Write([]byte("1234"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("56789"))
+		}
+	}))
+	defer backend.Close()
+
+	appCtx.backends = newBackendPool(strings.TrimPrefix(backend.URL, "http://"), "/", 0)
+
+	file, err := appCtx.requestFile("a.com/small", nil)
+	assert.Nil(t, err)
+	assert.False(t, file.Large)
+	assert.Equal(t, "12345678", string(file.Body))
+
+	file, err = appCtx.requestFile("a.com/large", nil)
+	assert.Nil(t, err)
+	assert.True(t, file.Large)
+	assert.Nil(t, file.Body)
+	assert.Equal(t, int64(9), file.Size)
+	assert.Equal(t, "123456789", readDiskFile(file.DiskPath))
+
+	file, err = appCtx.requestFile("a.com/chunked", nil)
+	assert.Nil(t, err)
+	assert.True(t, file.Large)
+	assert.Equal(t, int64(9), file.Size)
+	assert.Equal(t, "123456789", readDiskFile(file.DiskPath))
+
+	// without the disk cache the size of the streamed body is unknown
+	appCtx.diskCacheDir = ""
+	file, err = appCtx.requestFile("a.com/chunked", nil)
+	assert.Nil(t, err)
+	assert.True(t, file.Large)
+	assert.Equal(t, "", file.DiskPath)
+	assert.Equal(t, int64(-1), file.Size)
+}
+
+func TestLargeFileReplace(t *testing.T) {
+	appCtx, clean := testLargeFileContext(t)
+	defer clean()
+
+	header := map[string]string{"Portm-Type": "Binary"}
+
+	v1 := appCtx.newLargeFile("a.com/b", header, -1, strings.NewReader("version 1"))
+	appCtx.setFile("a.com/b", v1)
+
+	v2 := appCtx.newLargeFile("a.com/b", header, -1, strings.NewReader("version 2"))
+
+	// the cached version is untouched until it's replaced
+	assert.NotEqual(t, v1.DiskPath, v2.DiskPath)
+	assert.NotEqual(t, string(v1.ETag), string(v2.ETag))
+	assert.Equal(t, "version 1", readDiskFile(v1.DiskPath))
+
+	// the reader of the old version can finish after the replacement
+	f, err := os.Open(v1.DiskPath)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	appCtx.setFile("a.com/b", v2)
+
+	_, err = os.Stat(v1.DiskPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "version 2", readDiskFile(v2.DiskPath))
+
+	data, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "version 1", string(data))
+
+	// the same body keeps the same path
+	same := appCtx.newLargeFile("a.com/b", header, -1, strings.NewReader("version 2"))
+	appCtx.setFile("a.com/b", same)
+	assert.Equal(t, "version 2", readDiskFile(v2.DiskPath))
+
+	appCtx.delFile("a.com/b")
+	_, err = os.Stat(v2.DiskPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskFileRange(t *testing.T) {
+	appCtx, clean := testLargeFileContext(t)
+	defer clean()
+
+	file := appCtx.newLargeFile("a.com/b", map[string]string{"Portm-Type": "Binary"}, -1, strings.NewReader("0123456789"))
+
+	send := func(rangeHeader string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		if rangeHeader != "" {
+			ctx.Request.Header.Set("Range", rangeHeader)
+		}
+
+		f, err := os.Open(file.DiskPath)
+		assert.Nil(t, err)
+
+		appCtx.sendDiskFile(ctx, file, f)
+		return ctx
+	}
+
+	ctx := send("bytes=2-5")
+	assert.Equal(t, statusPartialContent, ctx.Response.StatusCode())
+	assert.Equal(t, "bytes 2-5/10", string(ctx.Response.Header.Peek("Content-Range")))
+	assert.Equal(t, "2345", string(ctx.Response.Body()))
+
+	ctx = send("bytes=-3")
+	assert.Equal(t, "789", string(ctx.Response.Body()))
+
+	ctx = send("bytes=20-")
+	assert.Equal(t, statusRangeNotSatisfiable, ctx.Response.StatusCode())
+	assert.Equal(t, "bytes */10", string(ctx.Response.Header.Peek("Content-Range")))
+
+	ctx = send("")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "0123456789", string(ctx.Response.Body()))
+}
+
+func TestIdleReader(t *testing.T) {
+	pr, pw := io.Pipe()
+	r := newIdleReader(pr, 50*time.Millisecond)
+	defer r.Close()
+
+	go pw.Write([]byte("ok"))
+
+	buf := make([]byte, 8)
+	n, err := r.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(buf[:n]))
+
+	// the stalled body is closed
+	startTime := time.Now()
+	_, err = r.Read(buf)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(startTime) < 10*time.Second)
+}
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// the bucket i covers [2^((i-1)/4), 2^(i/4)) microseconds, the bucket 0 is below 1 microsecond,
+	// so that the error of a percentile is within 19%, the last bucket holds the ones over about 50 minutes
+	latencyBucketCount = 128
+	latencySubBuckets  = 4
+
+	latencySlotSpan  = 15 * time.Second
+	latencySlotCount = 60 // 15 minutes
+
+	// a window takes up to about 30KB, only this many files have one, so that they take up to about 30MB
+	latencyMaxFiles = 1000
+)
+
+// the sliding windows of the latency summaries
+var latencyWindows = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+}
+
+// latencyWindow is a ring of fixed bucket histograms, each of them covers a slot of time.
+// The slots are allocated on demand, so that the rarely run files take little memory.
+type latencyWindow struct {
+	slots []*latencySlot
+	last  int64 // the slot of the last record
+}
+
+type latencySlot struct {
+	num    int64 // the index of the slot since the epoch
+	counts [latencyBucketCount]uint32
+	max    time.Duration
+}
+
+// the latency summary in milliseconds
+type latencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func newLatencyWindow() *latencyWindow {
+	return &latencyWindow{slots: make([]*latencySlot, latencySlotCount)}
+}
+
+func latencyBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+
+	i := int(math.Floor(math.Log2(us)*latencySubBuckets)) + 1
+	if i >= latencyBucketCount {
+		return latencyBucketCount - 1
+	}
+	return i
+}
+
+// the upper bound of the bucket
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(math.Pow(2, float64(i)/latencySubBuckets) * float64(time.Microsecond))
+}
+
+func latencySlotNum(now time.Time) int64 {
+	return now.UnixNano() / int64(latencySlotSpan)
+}
+
+func (w *latencyWindow) record(d time.Duration, now time.Time) {
+	num := latencySlotNum(now)
+	i := num % latencySlotCount
+
+	slot := w.slots[i]
+	if slot == nil || slot.num != num {
+		slot = &latencySlot{num: num}
+		w.slots[i] = slot
+	}
+
+	w.last = num
+	slot.counts[latencyBucket(d)]++
+	if d > slot.max {
+		slot.max = d
+	}
+}
+
+// all the slots are out of the window, so that the window can be freed
+func (w *latencyWindow) idle(now time.Time) bool {
+	return w.last <= latencySlotNum(now)-latencySlotCount
+}
+
+// the summary of the latencies in the span before now
+func (w *latencyWindow) summary(span time.Duration, now time.Time) *latencySummary {
+	num := latencySlotNum(now)
+	n := int64(span / latencySlotSpan)
+
+	var counts [latencyBucketCount]uint64
+	var total uint64
+	var max time.Duration
+
+	for _, slot := range w.slots {
+		if slot == nil || slot.num > num || slot.num <= num-n {
+			continue
+		}
+
+		for i, c := range slot.counts {
+			counts[i] += uint64(c)
+			total += uint64(c)
+		}
+		if slot.max > max {
+			max = slot.max
+		}
+	}
+
+	summary := &latencySummary{Count: total, Max: toMs(max)}
+	if total == 0 {
+		return summary
+	}
+
+	percentile := func(p float64) float64 {
+		rank := uint64(math.Ceil(p * float64(total)))
+		sum := uint64(0)
+		for i, c := range counts {
+			sum += c
+			if sum >= rank {
+				// the bound is an overestimate, the max is exact
+				if bound := latencyBucketBound(i); bound < max {
+					return toMs(bound)
+				}
+				break
+			}
+		}
+		return toMs(max)
+	}
+
+	summary.P50 = percentile(0.5)
+	summary.P90 = percentile(0.9)
+	summary.P99 = percentile(0.99)
+
+	return summary
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/umi"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow()
+	now := time.Unix(1000*15, 0)
+
+	for i := 0; i < 98; i++ {
+		w.record(time.Millisecond, now)
+	}
+	w.record(100*time.Millisecond, now)
+	w.record(2*time.Second, now)
+
+	s := w.summary(time.Minute, now)
+	assert.Equal(t, uint64(100), s.Count)
+	assert.InDelta(t, 1, s.P50, 0.2)
+	assert.InDelta(t, 1, s.P90, 0.2)
+	assert.InDelta(t, 100, s.P99, 20)
+	assert.Equal(t, 2000.0, s.Max)
+
+	// the old slots slide out of the window
+	later := now.Add(2 * time.Minute)
+	w.record(5*time.Millisecond, later)
+
+	s = w.summary(time.Minute, later)
+	assert.Equal(t, uint64(1), s.Count)
+	assert.Equal(t, 5.0, s.P50)
+	assert.Equal(t, 5.0, s.Max)
+
+	s = w.summary(5*time.Minute, later)
+	assert.Equal(t, uint64(101), s.Count)
+
+	assert.False(t, w.idle(later.Add(14*time.Minute)))
+	assert.True(t, w.idle(later.Add(15*time.Minute)))
+}
+
+func TestLatencyBucket(t *testing.T) {
+	assert.Equal(t, 0, latencyBucket(0))
+	assert.Equal(t, 1, latencyBucket(time.Microsecond))
+	assert.Equal(t, latencyBucketCount-1, latencyBucket(10*time.Hour))
+
+	for _, d := range []time.Duration{time.Microsecond, 3 * time.Millisecond, 7 * time.Second} {
+		assert.True(t, d < latencyBucketBound(latencyBucket(d)))
+	}
+}
+
+func TestLatencyMaxFiles(t *testing.T) {
+	cost := newCostCache()
+
+	for i := 0; i < latencyMaxFiles+10; i++ {
+		cost.end(fmt.Sprint("a.com/", i), uint64(time.Millisecond))
+	}
+
+	assert.Equal(t, latencyMaxFiles+10, cost.cache.Count())
+	assert.Len(t, cost.windowed(), latencyMaxFiles)
+	assert.Nil(t, cost.get(fmt.Sprint("a.com/", latencyMaxFiles)).latency)
+
+	// the windows of the evicted files free the room
+	cost.cache.Del("a.com/0")
+	cost.setQPS()
+	assert.Len(t, cost.windowed(), latencyMaxFiles-1)
+
+	cost.end(fmt.Sprint("a.com/", latencyMaxFiles), uint64(time.Millisecond))
+	assert.NotNil(t, cost.get(fmt.Sprint("a.com/", latencyMaxFiles)).latency)
+	assert.Len(t, cost.windowed(), latencyMaxFiles)
+
+	// the window without a run in the last 15 minutes frees the room
+	idle := cost.get("a.com/1")
+	cost.lock.Lock()
+	idle.latency.last -= latencySlotCount
+	cost.lock.Unlock()
+	cost.setQPS()
+	assert.Len(t, cost.windowed(), latencyMaxFiles-1)
+
+	cost.end(fmt.Sprint("a.com/", latencyMaxFiles+1), uint64(time.Millisecond))
+	assert.Len(t, cost.windowed(), latencyMaxFiles)
+
+	hot := cost.get(fmt.Sprint("a.com/", latencyMaxFiles+1))
+	cost.lock.RLock()
+	assert.Nil(t, idle.latency)
+	assert.NotNil(t, hot.latency)
+	cost.lock.RUnlock()
+}
+
+func TestCostListSort(t *testing.T) {
+	appCtx := testAppContext()
+	appCtx.cache = umi.New(nil)
+	appCtx.cost = newCostCache()
+
+	for i, d := range []time.Duration{time.Millisecond, 3 * time.Millisecond, 2 * time.Millisecond} {
+		uri := fmt.Sprint("a.com/", i)
+		appCtx.cache.Set(uri, &File{})
+		appCtx.cost.end(uri, uint64(d))
+	}
+
+	// the file without a window isn't in the sorted list
+	appCtx.cache.Set("a.com/3", &File{})
+	appCtx.cost.cache.Set("a.com/3", &costInfo{})
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/cost-list?sort=max&limit=2")
+	appCtx.costList(ctx)
+
+	var res struct {
+		Count int
+		List  []struct{ URI string }
+	}
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &res))
+	assert.Equal(t, 3, res.Count)
+	assert.Len(t, res.List, 2)
+	assert.Equal(t, "a.com/1", res.List[0].URI)
+	assert.Equal(t, "a.com/2", res.List[1].URI)
+}
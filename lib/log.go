@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"encoding/json"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -29,3 +30,30 @@ func (log *logCache) http(uri string, status int, msg string) {
 		Time:    time.Now(),
 	})
 }
+
+const logListKey = "logList"
+
+func (log *logCache) save() error {
+	list := []*httpLog{}
+	for _, item := range log.cache.Items() {
+		list = append(list, item.Value().(*httpLog))
+	}
+
+	data, _ := json.Marshal(list)
+	return db.Put([]byte(logListKey), data, nil)
+}
+
+// restore the logs saved by the last shutdown
+func (log *logCache) load() {
+	data, err := db.Get([]byte(logListKey), nil)
+	if err != nil {
+		return
+	}
+
+	list := []*httpLog{}
+	json.Unmarshal(data, &list)
+
+	for _, l := range list {
+		log.cache.Set(strconv.FormatUint(atomic.AddUint64(&log.index, 1), 36), l)
+	}
+}
@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/umi"
+)
+
+// the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative latency histogram of the prometheus
+type histogram struct {
+	counts []uint64 // the last one is the +Inf
+	sum    int64    // nanoseconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// hitCounter counts the lookups of a cache
+type hitCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *hitCounter) record(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// the lookups of the file cache by the cache status
+type fileCacheStats struct {
+	hit      uint64
+	stale    uint64
+	miss     uint64
+	overload uint64
+}
+
+func (stats *fileCacheStats) record(cacheStatus string) {
+	switch cacheStatus {
+	case cacheHit:
+		atomic.AddUint64(&stats.hit, 1)
+	case cacheStale:
+		atomic.AddUint64(&stats.stale, 1)
+	case cacheMiss:
+		atomic.AddUint64(&stats.miss, 1)
+	case cacheOverload:
+		atomic.AddUint64(&stats.overload, 1)
+	}
+}
+
+// metricsWriter writes the prometheus text format
+type metricsWriter struct {
+	buf *bytes.Buffer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (w *metricsWriter) family(name string, kind string, help string) {
+	w.buf.WriteString("# HELP " + name + " " + help + "\n")
+	w.buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// the labels are the pairs of the names and values
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i < len(labels)-1; i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		w.buf.WriteByte('}')
+	}
+
+	w.buf.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func (w *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	total := uint64(0)
+	for i, bound := range latencyBuckets {
+		total += atomic.LoadUint64(&h.counts[i])
+		w.sample(name+"_bucket", float64(total), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	total += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+	w.sample(name+"_bucket", float64(total), append(labels, "le", "+Inf")...)
+	w.sample(name+"_sum", time.Duration(atomic.LoadInt64(&h.sum)).Seconds(), labels...)
+	w.sample(name+"_count", float64(total), labels...)
+}
+
+func hitRatio(hits uint64, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (appCtx *AppContext) writeMetrics(w *metricsWriter) {
+	codes := appCtx.reqCount.getStatusCodes()
+	list := []int{}
+	for code := range codes {
+		list = append(list, code)
+	}
+	sort.Ints(list)
+
+	w.family("portal_requests_total", "counter", "The requests of the file service by the status code.")
+	for _, code := range list {
+		if code != statusPassThroughCache {
+			w.sample("portal_requests_total", float64(codes[code]), "code", strconv.Itoa(code))
+		}
+	}
+
+	w.family("portal_cache_pass_through_total", "counter", "The requests fetched from the backend.")
+	w.sample("portal_cache_pass_through_total", float64(codes[statusPassThroughCache]))
+
+	w.family("portal_qps", "gauge", "The requests per second of the file service.")
+	w.sample("portal_qps", appCtx.reqCount.statusCodeQPS)
+
+	w.family("portal_working_count", "gauge", "The fetches from the backend in progress.")
+	w.sample("portal_working_count", float64(atomic.LoadInt32(&appCtx.workingCount)))
+
+	w.family("portal_active_requests", "gauge", "The requests being handled by the file service.")
+	w.sample("portal_active_requests", float64(atomic.LoadInt32(&appCtx.activeCount)))
+
+	w.family("portal_overload_queue_length", "gauge", "The overloaded files and globs waiting to be retried.")
+	w.sample("portal_overload_queue_length", float64(appCtx.overloadMointer.cache.Count()+len(appCtx.overloadMointer.action)))
+
+	caches := []struct {
+		name  string
+		cache *umi.Cache
+	}{
+		{"file", appCtx.cache},
+		{"glob_desc", appCtx.glob.descCache},
+		{"glob_asc", appCtx.glob.ascCache},
+		{"runtime", appCtx.runtimeCache.cache},
+		{"log", appCtx.log.cache},
+		{"cost", appCtx.cost.cache},
+		{"overload", appCtx.overloadMointer.cache},
+		{"peer_events", appCtx.peers.seen},
+	}
+
+	w.family("portal_cache_size_bytes", "gauge", "The memory size of the cache.")
+	for _, c := range caches {
+		w.sample("portal_cache_size_bytes", float64(c.cache.Size()), "cache", c.name)
+	}
+
+	w.family("portal_cache_items", "gauge", "The number of the items in the cache.")
+	for _, c := range caches {
+		w.sample("portal_cache_items", float64(c.cache.Count()), "cache", c.name)
+	}
+
+	stats := &appCtx.fileStats
+	fileHits := atomic.LoadUint64(&stats.hit) + atomic.LoadUint64(&stats.stale)
+	fileMisses := atomic.LoadUint64(&stats.miss) + atomic.LoadUint64(&stats.overload)
+
+	counters := []struct {
+		name   string
+		hits   uint64
+		misses uint64
+	}{
+		{"file", fileHits, fileMisses},
+		{"glob", atomic.LoadUint64(&appCtx.glob.stats.hits), atomic.LoadUint64(&appCtx.glob.stats.misses)},
+		{"runtime", atomic.LoadUint64(&appCtx.runtimeCache.stats.hits), atomic.LoadUint64(&appCtx.runtimeCache.stats.misses)},
+	}
+
+	w.family("portal_cache_hits_total", "counter", "The lookups found in the cache, the stale files are hits.")
+	for _, c := range counters {
+		w.sample("portal_cache_hits_total", float64(c.hits), "cache", c.name)
+	}
+
+	w.family("portal_cache_misses_total", "counter", "The lookups not found in the cache.")
+	for _, c := range counters {
+		w.sample("portal_cache_misses_total", float64(c.misses), "cache", c.name)
+	}
+
+	w.family("portal_cache_hit_ratio", "gauge", "The hits divided by the lookups since the start.")
+	for _, c := range counters {
+		w.sample("portal_cache_hit_ratio", hitRatio(c.hits, c.misses), "cache", c.name)
+	}
+
+	w.family("portal_file_cache_lookups_total", "counter", "The lookups of the file cache by the cache status.")
+	for _, s := range []struct {
+		status string
+		count  *uint64
+	}{
+		{cacheHit, &stats.hit},
+		{cacheStale, &stats.stale},
+		{cacheMiss, &stats.miss},
+		{cacheOverload, &stats.overload},
+	} {
+		w.sample("portal_file_cache_lookups_total", float64(atomic.LoadUint64(s.count)), "status", s.status)
+	}
+
+	backends := appCtx.backends.getList()
+
+	w.family("portal_backend_up", "gauge", "Whether the backend is healthy.")
+	for _, b := range backends {
+		w.sample("portal_backend_up", float64(atomic.LoadInt32(&b.healthy)), "backend", b.addr)
+	}
+
+	w.family("portal_backend_errors_total", "counter", "The failed requests to the backend.")
+	for _, b := range backends {
+		w.sample("portal_backend_errors_total", float64(atomic.LoadUint64(&b.errorCount)), "backend", b.addr)
+	}
+
+	w.family("portal_backend_fetch_seconds", "histogram", "The latency of the requests to the backend.")
+	for _, b := range backends {
+		w.histogram("portal_backend_fetch_seconds", b.fetchLatency, "backend", b.addr)
+	}
+
+	appCtx.writeFileMetrics(w, appCtx.conf().MetricsMaxFiles)
+}
+
+// the per-file series of the most costly files, the rest are dropped to cap the cardinality
+func (appCtx *AppContext) writeFileMetrics(w *metricsWriter, max int) {
+	type fileItem struct {
+		uri      string
+		cost     uint64
+		count    uint64
+		rejected uint64
+	}
+
+	appCtx.cost.lock.RLock()
+	items := []fileItem{}
+	for _, item := range appCtx.cost.cache.Items() {
+		info := item.Value().(*costInfo)
+		items = append(items, fileItem{item.Key(), info.cost, info.count, info.rejected})
+	}
+	appCtx.cost.lock.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].cost == items[j].cost {
+			return items[i].uri < items[j].uri
+		}
+		return items[i].cost > items[j].cost
+	})
+
+	dropped := 0
+	if len(items) > max {
+		dropped = len(items) - max
+		items = items[:max]
+	}
+
+	w.family("portal_file_cost_seconds_total", "counter", "The gisp run time of the file.")
+	for _, item := range items {
+		w.sample("portal_file_cost_seconds_total", time.Duration(item.cost).Seconds(), "uri", item.uri)
+	}
+
+	w.family("portal_file_runs_total", "counter", "The gisp runs of the file.")
+	for _, item := range items {
+		w.sample("portal_file_runs_total", float64(item.count), "uri", item.uri)
+	}
+
+	w.family("portal_file_rejected_total", "counter", "The gisp runs of the file rejected by the quota or the concurrency.")
+	for _, item := range items {
+		w.sample("portal_file_rejected_total", float64(item.rejected), "uri", item.uri)
+	}
+
+	w.family("portal_file_series_dropped", "gauge", "The files without the per-file series because of the metricsMaxFiles.")
+	w.sample("portal_file_series_dropped", float64(dropped))
+}
+
+// curl 127.0.0.1:7071/metrics
+func (appCtx *AppContext) handleMetrics(ctx *fasthttp.RequestCtx) {
+	w := &metricsWriter{buf: &bytes.Buffer{}}
+
+	appCtx.writeMetrics(w)
+
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	ctx.Write(w.buf.Bytes())
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(3 * time.Millisecond)
+	h.observe(200 * time.Millisecond)
+	h.observe(time.Minute)
+
+	w := &metricsWriter{buf: &bytes.Buffer{}}
+	w.histogram("a", h, "backend", `b"1`)
+
+	out := w.buf.String()
+	assert.Contains(t, out, `a_bucket{backend="b\"1",le="0.005"} 1`+"\n")
+	assert.Contains(t, out, `a_bucket{backend="b\"1",le="0.25"} 2`+"\n")
+	assert.Contains(t, out, `a_bucket{backend="b\"1",le="+Inf"} 3`+"\n")
+	assert.Contains(t, out, `a_count{backend="b\"1"} 3`+"\n")
+}
+
+func TestFileMetricsCap(t *testing.T) {
+	appCtx := &AppContext{cost: newCostCache()}
+	appCtx.cost.end("a", 3)
+	appCtx.cost.end("b", 2e9)
+	appCtx.cost.end("c", 1)
+
+	w := &metricsWriter{buf: &bytes.Buffer{}}
+	appCtx.writeFileMetrics(w, 2)
+
+	out := w.buf.String()
+	assert.Contains(t, out, `portal_file_cost_seconds_total{uri="b"} 2`+"\n")
+	assert.Contains(t, out, `portal_file_runs_total{uri="a"} 1`+"\n")
+	assert.NotContains(t, out, `uri="c"`)
+	assert.Contains(t, out, "portal_file_series_dropped 1\n")
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/umi"
+)
+
+const (
+	eventIDArg = "eventId"
+
+	// the events forwarded by the origin node have it, they won't be forwarded again
+	forwardedArg = "forwarded"
+
+	// the status of a duplicated event
+	statusAlreadyReported = 208
+)
+
+// peerGroup forwards the invalidations and purges to the other portal nodes.
+// Only the node which receives the event first forwards it, every event has an id,
+// so that the event received twice will be ignored
+type peerGroup struct {
+	list   []*peer
+	lock   *sync.Mutex
+	seen   *umi.Cache
+	client *http.Client
+}
+
+type peer struct {
+	addr         string
+	lock         *sync.Mutex
+	lastSyncTime int64
+	lastError    string
+	sentCount    uint64
+	failedCount  uint64
+}
+
+type peerDelivery struct {
+	Peer  string `json:"peer"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// the addrs are the control service addresses of the peers, separated by comma
+func newPeerGroup(addrs string) *peerGroup {
+	group := &peerGroup{
+		list: []*peer{},
+		lock: &sync.Mutex{},
+		seen: umi.New(&umi.Options{
+			MaxMemSize:  10 * 1024 * 1024, // 10MB
+			PromoteRate: -1,
+			TTL:         10 * time.Minute,
+		}),
+		client: &http.Client{
+			Timeout: 3 * time.Second,
+		},
+	}
+
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		group.list = append(group.list, &peer{
+			addr: addr,
+			lock: &sync.Mutex{},
+		})
+	}
+
+	return group
+}
+
+// returns false if the event has been received before
+func (group *peerGroup) receive(eventID string) bool {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	if _, has := group.seen.Get(eventID); has {
+		return false
+	}
+
+	group.seen.Set(eventID, true)
+	return true
+}
+
+// send the event to all the peers, and wait for the deliveries,
+// the token is the bearer token of the control services of the peers
+func (group *peerGroup) broadcast(path string, args *fasthttp.Args, token string) []*peerDelivery {
+	list := make([]*peerDelivery, len(group.list))
+	wg := &sync.WaitGroup{}
+
+	for i, p := range group.list {
+		wg.Add(1)
+		go func(i int, p *peer) {
+			err := group.send(p, path, args, token)
+
+			delivery := &peerDelivery{Peer: p.addr, OK: err == nil}
+			if err != nil {
+				delivery.Error = err.Error()
+				fmt.Fprintln(os.Stderr, "peer "+p.addr+" error:\n"+err.Error())
+			}
+			list[i] = delivery
+
+			wg.Done()
+		}(i, p)
+	}
+
+	wg.Wait()
+
+	return list
+}
+
+func (group *peerGroup) send(p *peer, path string, args *fasthttp.Args, token string) error {
+	atomic.AddUint64(&p.sentCount, 1)
+
+	req, _ := http.NewRequest("GET", (&url.URL{
+		Scheme:   "http",
+		Host:     p.addr,
+		Path:     path,
+		RawQuery: args.String(),
+	}).String(), nil)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := group.client.Do(req)
+
+	if err == nil {
+		defer res.Body.Close()
+
+		if res.StatusCode != 200 && res.StatusCode != statusAlreadyReported {
+			body, _ := ioutil.ReadAll(res.Body)
+			err = errors.New(strconv.Itoa(res.StatusCode) + " " + string(body))
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err != nil {
+		atomic.AddUint64(&p.failedCount, 1)
+		p.lastError = err.Error()
+		return err
+	}
+
+	p.lastSyncTime = time.Now().UnixNano()
+	p.lastError = ""
+	return nil
+}
+
+func (group *peerGroup) status() []map[string]interface{} {
+	list := []map[string]interface{}{}
+
+	for _, p := range group.list {
+		p.lock.Lock()
+		list = append(list, map[string]interface{}{
+			"addr":         p.addr,
+			"lastSyncTime": p.lastSyncTime / 1000 / 1000,
+			"lastError":    p.lastError,
+			"sentCount":    atomic.LoadUint64(&p.sentCount),
+			"failedCount":  atomic.LoadUint64(&p.failedCount),
+		})
+		p.lock.Unlock()
+	}
+
+	return list
+}
+
+// The first node of the event assigns the event id.
+// Returns false if the event is a duplicate, the response is written with the status 208.
+func (appCtx *AppContext) receiveEvent(ctx *fasthttp.RequestCtx) (args *fasthttp.Args, isNew bool) {
+	args = &fasthttp.Args{}
+	ctx.QueryArgs().CopyTo(args)
+
+	eventID := string(args.Peek(eventIDArg))
+	if eventID == "" {
+		eventID = uuid.NewV4().String()
+		args.Set(eventIDArg, eventID)
+	}
+
+	if !appCtx.peers.receive(eventID) {
+		ctx.SetStatusCode(statusAlreadyReported)
+		ctx.WriteString("duplicated event")
+		return args, false
+	}
+
+	return args, true
+}
+
+// forward the event to the peers if this node is the origin of it,
+// returns nil if the event shouldn't be forwarded
+func (appCtx *AppContext) forward(path string, args *fasthttp.Args) []*peerDelivery {
+	if len(appCtx.peers.list) == 0 || len(args.Peek(forwardedArg)) > 0 {
+		return nil
+	}
+
+	args.Set(forwardedArg, "1")
+
+	return appCtx.peers.broadcast(path, args, appCtx.conf().CtrlAuthKey)
+}
+
+// forward the control request to the peers, and respond the per-peer delivery status
+func (appCtx *AppContext) fanOut(ctx *fasthttp.RequestCtx, args *fasthttp.Args) {
+	deliveries := appCtx.forward(string(ctx.Path()), args)
+	if deliveries == nil {
+		return
+	}
+
+	data, _ := json.Marshal(deliveries)
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(data)
+}
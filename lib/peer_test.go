@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestReceiveEvent(t *testing.T) {
+	appCtx := &AppContext{peers: newPeerGroup("")}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/purge")
+	args, isNew := appCtx.receiveEvent(ctx)
+	assert.True(t, isNew)
+
+	// the id assigned by the origin node is kept by the peers
+	eventID := string(args.Peek(eventIDArg))
+	assert.NotEmpty(t, eventID)
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/purge?eventId=" + eventID)
+	_, isNew = appCtx.receiveEvent(ctx)
+	assert.False(t, isNew)
+	assert.Equal(t, statusAlreadyReported, ctx.Response.StatusCode())
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/purge?eventId=other")
+	_, isNew = appCtx.receiveEvent(ctx)
+	assert.True(t, isNew)
+}
+
+func TestForwardEvent(t *testing.T) {
+	queries := []string{}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		w.WriteHeader(statusAlreadyReported)
+	}))
+	defer peer.Close()
+
+	appCtx := &AppContext{peers: newPeerGroup(strings.TrimPrefix(peer.URL, "http://"))}
+	appCtx.config.Store(testConfig())
+
+	args := &fasthttp.Args{}
+	args.Set(eventIDArg, "1")
+
+	deliveries := appCtx.forward("/purge", args)
+	assert.Len(t, deliveries, 1)
+	assert.True(t, deliveries[0].OK)
+
+	// the forwarded event won't be forwarded again
+	assert.Nil(t, appCtx.forward("/purge", args))
+	assert.Equal(t, []string{"eventId=1&forwarded=1"}, queries)
+}
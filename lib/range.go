@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	statusPartialContent      = 206
+	statusRangeNotSatisfiable = 416
+
+	maxRanges = 16
+)
+
+type byteRange struct {
+	start int
+	end   int // inclusive
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+func (r byteRange) contentRange(size int) string {
+	return "bytes " + strconv.Itoa(r.start) + "-" + strconv.Itoa(r.end) + "/" + strconv.Itoa(size)
+}
+
+// Parse the Range header, such as "bytes=0-499, 500-, -200".
+// Returns nil if the header should be ignored, such as the invalid syntax,
+// the error is returned only if none of the valid ranges overlaps the body.
+func parseRange(header string, size int) ([]byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+
+	list := []byteRange{}
+	count := 0
+
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		index := strings.IndexByte(spec, '-')
+		if index < 0 {
+			return nil, nil
+		}
+
+		startStr := strings.TrimSpace(spec[:index])
+		endStr := strings.TrimSpace(spec[index+1:])
+
+		count++
+
+		if startStr == "" {
+			// the suffix range, the last n bytes
+			n, err := strconv.Atoi(endStr)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			list = append(list, byteRange{size - n, size - 1})
+			continue
+		}
+
+		start, err := strconv.Atoi(startStr)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+
+		end := size - 1
+		if endStr != "" {
+			end, err = strconv.Atoi(endStr)
+			if err != nil || end < start {
+				return nil, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+
+		if start >= size {
+			continue
+		}
+
+		list = append(list, byteRange{start, end})
+	}
+
+	if count == 0 {
+		return nil, nil
+	}
+
+	if len(list) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+
+	// too many ranges could be abused, just serve the whole file
+	if len(list) > maxRanges {
+		return nil, nil
+	}
+
+	return list, nil
+}
+
+// The If-Range matches the strong ETag or the exact Last-Modified of the file,
+// the weak ETag never matches, so that the parts of the different bodies won't be mixed.
+func ifRangeMatch(ifRange []byte, file *File) bool {
+	if ifRange == nil {
+		return true
+	}
+
+	if bytes.HasPrefix(ifRange, []byte("W/")) {
+		return false
+	}
+
+	if bytes.HasPrefix(ifRange, []byte(`"`)) {
+		return !bytes.HasPrefix(file.ETag, []byte("W/")) && bytes.Equal(ifRange, file.ETag)
+	}
+
+	t, err := fasthttp.ParseHTTPDate(ifRange)
+	modTime := file.modifiedTime()
+	return err == nil && !modTime.IsZero() && modTime.Truncate(time.Second).Equal(t)
+}
+
+// Handle the Range and If-Range headers of the binary file.
+// Returns true if the response has been written.
+func (appCtx *AppContext) handleRange(ctx *fasthttp.RequestCtx, file *File) bool {
+	ctx.Response.Header.Set("Accept-Ranges", "bytes")
+
+	header := string(ctx.Request.Header.Peek("Range"))
+	if header == "" {
+		return false
+	}
+
+	// the file has changed since the client got the part of it
+	if !ifRangeMatch(ctx.Request.Header.Peek("If-Range"), file) {
+		return false
+	}
+
+	size := len(file.Body)
+	ranges, err := parseRange(header, size)
+
+	if err != nil {
+		ctx.Response.Header.Set("Content-Range", "bytes */"+strconv.Itoa(size))
+		ctx.SetStatusCode(statusRangeNotSatisfiable)
+		return true
+	}
+
+	if ranges == nil {
+		return false
+	}
+
+	ctx.SetStatusCode(statusPartialContent)
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		ctx.Response.Header.Set("Content-Range", r.contentRange(size))
+		ctx.Write(file.Body[r.start : r.end+1])
+		return true
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	for _, r := range ranges {
+		part, _ := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {file.ContentType},
+			"Content-Range": {r.contentRange(size)},
+		})
+		part.Write(file.Body[r.start : r.end+1])
+	}
+	w.Close()
+
+	ctx.SetContentType("multipart/byteranges; boundary=" + w.Boundary())
+	ctx.Write(buf.Bytes())
+	return true
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	ranges, err := parseRange("bytes=0-4", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []byteRange{{0, 4}}, ranges)
+
+	ranges, err = parseRange("bytes=5-, -3", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []byteRange{{5, 9}, {7, 9}}, ranges)
+
+	ranges, err = parseRange("bytes=8-100", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []byteRange{{8, 9}}, ranges)
+
+	_, err = parseRange("bytes=10-", 10)
+	assert.Equal(t, errRangeNotSatisfiable, err)
+
+	_, err = parseRange("bytes=10-, 20-30", 10)
+	assert.Equal(t, errRangeNotSatisfiable, err)
+
+	_, err = parseRange("bytes=-0", 10)
+	assert.Equal(t, errRangeNotSatisfiable, err)
+
+	// the suffix range of an empty body
+	_, err = parseRange("bytes=-5", 0)
+	assert.Equal(t, errRangeNotSatisfiable, err)
+
+	// the invalid syntax is ignored, the whole body is served
+	for _, header := range []string{"bytes=5-1", "bytes=a-b", "bytes=1", "bytes=--1", "bytes=", "bytes=0-1,x"} {
+		ranges, err = parseRange(header, 10)
+		assert.Nil(t, err, header)
+		assert.Nil(t, ranges, header)
+	}
+
+	ranges, err = parseRange("items=0-1", 10)
+	assert.Nil(t, err)
+	assert.Nil(t, ranges)
+}
+
+func TestIfRangeMatch(t *testing.T) {
+	file := newFile("a.com/b", map[string]string{
+		"Portm-Type":        "Binary",
+		"Portm-Modify-Time": "2018-01-02T03:04:05Z",
+	}, []byte("0123456789"))
+
+	assert.True(t, ifRangeMatch(nil, file))
+
+	// the etag of the file is weak
+	assert.False(t, ifRangeMatch(file.ETag, file))
+	assert.False(t, ifRangeMatch([]byte(strings.TrimPrefix(string(file.ETag), "W/")), file))
+
+	assert.True(t, ifRangeMatch([]byte("Tue, 02 Jan 2018 03:04:05 GMT"), file))
+	assert.False(t, ifRangeMatch([]byte("Tue, 02 Jan 2018 03:04:06 GMT"), file))
+	assert.False(t, ifRangeMatch([]byte("x"), file))
+
+	strong := &File{ETag: []byte(`"abc"`)}
+	assert.True(t, ifRangeMatch([]byte(`"abc"`), strong))
+	assert.False(t, ifRangeMatch([]byte(`W/"abc"`), strong))
+	assert.False(t, ifRangeMatch([]byte("Tue, 02 Jan 2018 03:04:05 GMT"), strong))
+}
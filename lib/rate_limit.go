@@ -0,0 +1,349 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	rateLimitsKey = "rateLimits"
+
+	// the buckets of the keys chosen by the clients are bounded, the ip buckets are used after it
+	rateLimitMaxBuckets = 10000
+)
+
+// rateLimitRule limits the requests of each client with a token bucket
+type rateLimitRule struct {
+	ID    string  `json:"id"`
+	Host  string  `json:"host,omitempty"` // regexp of the host, empty matches any
+	Path  string  `json:"path,omitempty"` // regexp of the path, empty matches any
+	Key   string  `json:"key,omitempty"`  // "ip", "header:{name}" or "cookie:{name}", the client ip is used if it's empty
+	Rate  float64 `json:"rate"`           // tokens added per second
+	Burst int     `json:"burst"`          // size of the bucket
+
+	allowed uint64
+	limited uint64
+	hostReg *regexp.Regexp
+	pathReg *regexp.Regexp
+	lock    *sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter picks the first matched rule of the request
+type rateLimiter struct {
+	lock  *sync.RWMutex
+	rules []*rateLimitRule
+}
+
+func newRateLimiter() *rateLimiter {
+	limiter := &rateLimiter{
+		lock:  &sync.RWMutex{},
+		rules: []*rateLimitRule{},
+	}
+
+	data, err := db.Get([]byte(rateLimitsKey), nil)
+	if err == nil {
+		limiter.rules, err = parseRateLimitRules(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return limiter
+}
+
+func parseRateLimitRules(data []byte) ([]*rateLimitRule, error) {
+	rules := []*rateLimitRule{}
+
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]bool{}
+
+	for _, rule := range rules {
+		if rule == nil {
+			return nil, errors.New("rate limit rule is null")
+		}
+
+		if rule.ID == "" || ids[rule.ID] {
+			return nil, errors.New("rate limit rule id should be unique and not empty: " + rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.Rate <= 0 || rule.Burst < 1 {
+			return nil, errors.New("rate limit rule rate and burst should be positive: " + rule.ID)
+		}
+
+		if rule.Key != "" && rule.Key != "ip" &&
+			!strings.HasPrefix(rule.Key, "header:") && !strings.HasPrefix(rule.Key, "cookie:") {
+			return nil, errors.New("rate limit rule key should be ip, header:{name} or cookie:{name}: " + rule.ID)
+		}
+
+		rule.hostReg, err = regexp.Compile(rule.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.pathReg, err = regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.lock = &sync.Mutex{}
+		rule.buckets = map[string]*tokenBucket{}
+	}
+
+	return rules, nil
+}
+
+// replace the rules and persist them, the counters of the rules with the same id are kept
+func (limiter *rateLimiter) set(data []byte) error {
+	rules, err := parseRateLimitRules(data)
+	if err != nil {
+		return err
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	prev := map[string]*rateLimitRule{}
+	for _, rule := range limiter.rules {
+		prev[rule.ID] = rule
+	}
+	for _, rule := range rules {
+		if p, has := prev[rule.ID]; has {
+			rule.allowed = atomic.LoadUint64(&p.allowed)
+			rule.limited = atomic.LoadUint64(&p.limited)
+		}
+	}
+
+	data, _ = json.Marshal(rules)
+	err = db.Put([]byte(rateLimitsKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	limiter.rules = rules
+	return nil
+}
+
+// clear the buckets and the counters
+func (limiter *rateLimiter) reset() {
+	limiter.lock.RLock()
+	defer limiter.lock.RUnlock()
+
+	for _, rule := range limiter.rules {
+		rule.lock.Lock()
+		rule.buckets = map[string]*tokenBucket{}
+		rule.lock.Unlock()
+		atomic.StoreUint64(&rule.allowed, 0)
+		atomic.StoreUint64(&rule.limited, 0)
+	}
+}
+
+func (limiter *rateLimiter) match(host string, path string) *rateLimitRule {
+	limiter.lock.RLock()
+	defer limiter.lock.RUnlock()
+
+	for _, rule := range limiter.rules {
+		if rule.hostReg.MatchString(host) && rule.pathReg.MatchString(path) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// drop the full buckets, they are the same as the new ones
+func (limiter *rateLimiter) worker() {
+	for {
+		time.Sleep(time.Minute)
+
+		now := time.Now()
+
+		limiter.lock.RLock()
+		for _, rule := range limiter.rules {
+			rule.lock.Lock()
+			for client, bucket := range rule.buckets {
+				if rule.refill(bucket, now) >= float64(rule.Burst) {
+					delete(rule.buckets, client)
+				}
+			}
+			rule.lock.Unlock()
+		}
+		limiter.lock.RUnlock()
+	}
+}
+
+func (limiter *rateLimiter) marshal() []byte {
+	limiter.lock.RLock()
+	defer limiter.lock.RUnlock()
+
+	list := make([]map[string]interface{}, len(limiter.rules))
+	for i, rule := range limiter.rules {
+		rule.lock.Lock()
+		clients := len(rule.buckets)
+		rule.lock.Unlock()
+
+		list[i] = map[string]interface{}{
+			"id":      rule.ID,
+			"host":    rule.Host,
+			"path":    rule.Path,
+			"key":     rule.Key,
+			"rate":    rule.Rate,
+			"burst":   rule.Burst,
+			"allowed": atomic.LoadUint64(&rule.allowed),
+			"limited": atomic.LoadUint64(&rule.limited),
+			"clients": clients,
+		}
+	}
+
+	data, _ := json.Marshal(list)
+	return data
+}
+
+// the client of the request, the key is empty if the rule limits the ip or the header or cookie is missing
+func (rule *rateLimitRule) client(ctx *fasthttp.RequestCtx) (key string, ip string) {
+	var value []byte
+
+	switch {
+	case strings.HasPrefix(rule.Key, "header:"):
+		value = ctx.Request.Header.Peek(rule.Key[len("header:"):])
+	case strings.HasPrefix(rule.Key, "cookie:"):
+		value = ctx.Request.Header.Cookie(rule.Key[len("cookie:"):])
+	}
+
+	ip = "ip:" + ctx.RemoteIP().String()
+
+	if len(value) == 0 {
+		return "", ip
+	}
+	return rule.Key + ":" + string(value), ip
+}
+
+func (rule *rateLimitRule) refill(bucket *tokenBucket, now time.Time) float64 {
+	bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rule.Rate)
+	bucket.last = now
+	return bucket.tokens
+}
+
+func (rule *rateLimitRule) get(client string, now time.Time) *tokenBucket {
+	bucket, has := rule.buckets[client]
+	if !has {
+		bucket = &tokenBucket{tokens: float64(rule.Burst), last: now}
+		rule.buckets[client] = bucket
+	}
+	return bucket
+}
+
+func (rule *rateLimitRule) spend(bucket *tokenBucket, now time.Time) bool {
+	if rule.refill(bucket, now) < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// The bucket of the key, or the ip if the key is empty.
+// The key is chosen by the client, so a new key costs a token of the ip, and the ip bucket
+// is used when it has no token or the rule has too many buckets, then the limit can't be
+// bypassed by changing the key on every request.
+func (rule *rateLimitRule) pick(key string, ip string, now time.Time) *tokenBucket {
+	if key == "" {
+		return rule.get(ip, now)
+	}
+
+	if bucket, has := rule.buckets[key]; has {
+		return bucket
+	}
+
+	ipBucket := rule.get(ip, now)
+	if len(rule.buckets) >= rateLimitMaxBuckets || !rule.spend(ipBucket, now) {
+		return ipBucket
+	}
+
+	return rule.get(key, now)
+}
+
+// Take a token of the client.
+// Returns the tokens left, and the duration to wait for the next token if it's rejected.
+func (rule *rateLimitRule) take(key string, ip string, now time.Time) (ok bool, remaining float64, wait time.Duration) {
+	rule.lock.Lock()
+	defer rule.lock.Unlock()
+
+	bucket := rule.pick(key, ip, now)
+
+	if rule.spend(bucket, now) {
+		atomic.AddUint64(&rule.allowed, 1)
+		return true, bucket.tokens, 0
+	}
+
+	atomic.AddUint64(&rule.limited, 1)
+	return false, bucket.tokens, time.Duration((1 - bucket.tokens) / rule.Rate * float64(time.Second))
+}
+
+// Returns false if the request is limited.
+func (appCtx *AppContext) checkRateLimit(ctx *fasthttp.RequestCtx) bool {
+	rule := appCtx.rateLimiter.match(string(ctx.Host()), string(ctx.Path()))
+	if rule == nil {
+		return true
+	}
+
+	key, ip := rule.client(ctx)
+	ok, remaining, wait := rule.take(key, ip, time.Now())
+
+	// the seconds until the bucket is full
+	reset := math.Ceil((float64(rule.Burst) - remaining) / rule.Rate)
+
+	header := &ctx.Response.Header
+	header.Set("RateLimit-Limit", strconv.Itoa(rule.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+
+	if ok {
+		return true
+	}
+
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	appCtx.reqCount.chStatusCode <- statusTooManyRequests
+	ctx.SetStatusCode(statusTooManyRequests)
+	ctx.WriteString("Too Many Requests")
+	return false
+}
+
+// curl 127.0.0.1:7071/rate-limits
+// curl -d '[{"id": "api", "path": "^/api/", "key": "header:X-Api-Key", "rate": 10, "burst": 20}]' 127.0.0.1:7071/rate-limits
+// curl 127.0.0.1:7071/rate-limits?action=reset
+func (appCtx *AppContext) handleRateLimits(ctx *fasthttp.RequestCtx) {
+	var err error
+
+	if ctx.IsPost() {
+		err = appCtx.rateLimiter.set(ctx.PostBody())
+	} else if string(ctx.QueryArgs().Peek("action")) == "reset" {
+		appCtx.rateLimiter.reset()
+	}
+
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(appCtx.rateLimiter.marshal())
+}
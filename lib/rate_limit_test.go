@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	rules, err := parseRateLimitRules([]byte(`[{"id": "api", "path": "^/api/", "key": "header:X-Api-Key", "rate": 2, "burst": 2}]`))
+	assert.Nil(t, err)
+	rule := rules[0]
+
+	now := time.Now()
+
+	ok, remaining, _ := rule.take("a", "ip:1", now)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, remaining)
+
+	ok, _, _ = rule.take("a", "ip:1", now)
+	assert.True(t, ok)
+
+	ok, _, wait := rule.take("a", "ip:1", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// other clients have their own buckets
+	ok, _, _ = rule.take("b", "ip:1", now)
+	assert.True(t, ok)
+
+	ok, _, _ = rule.take("a", "ip:1", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	assert.Equal(t, uint64(4), rule.allowed)
+	assert.Equal(t, uint64(1), rule.limited)
+
+	// the new keys cost the tokens of the ip, the ip is limited after the "a" and "b"
+	ok, _, _ = rule.take("c", "ip:1", now)
+	assert.False(t, ok)
+	assert.NotContains(t, rule.buckets, "c")
+
+	// the ip is used after the rule has too many buckets
+	for i := len(rule.buckets); i < rateLimitMaxBuckets; i++ {
+		rule.buckets[strconv.Itoa(i)] = &tokenBucket{}
+	}
+	ok, _, _ = rule.take("d", "ip:2", now)
+	assert.True(t, ok)
+	assert.NotContains(t, rule.buckets, "d")
+	assert.Equal(t, 1.0, rule.buckets["ip:2"].tokens)
+
+	ctx := &fasthttp.RequestCtx{}
+	key, ip := rule.client(ctx)
+	assert.Equal(t, "", key)
+	assert.Equal(t, "ip:0.0.0.0", ip)
+
+	ctx.Request.Header.Set("X-Api-Key", "k")
+	key, _ = rule.client(ctx)
+	assert.Equal(t, "header:X-Api-Key:k", key)
+
+	_, err = parseRateLimitRules([]byte(`[{"id": "a", "rate": 0, "burst": 1}]`))
+	assert.NotNil(t, err)
+	_, err = parseRateLimitRules([]byte(`[{"id": "a", "key": "query:a", "rate": 1, "burst": 1}]`))
+	assert.NotNil(t, err)
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	rules, err := parseRateLimitRules([]byte(`[{"id": "all", "rate": 1, "burst": 1}]`))
+	assert.Nil(t, err)
+
+	appCtx := &AppContext{
+		rateLimiter: &rateLimiter{lock: &sync.RWMutex{}, rules: rules},
+		reqCount:    &reqCount{chStatusCode: make(chan int, 10)},
+	}
+
+	assert.True(t, appCtx.checkRateLimit(&fasthttp.RequestCtx{}))
+
+	ctx := &fasthttp.RequestCtx{}
+	assert.False(t, appCtx.checkRateLimit(ctx))
+	assert.Equal(t, statusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, "1", string(ctx.Response.Header.Peek("Retry-After")))
+
+	// only the limited request is counted here
+	assert.Equal(t, 1, len(appCtx.reqCount.chStatusCode))
+	assert.Equal(t, statusTooManyRequests, <-appCtx.reqCount.chStatusCode)
+}
@@ -86,6 +86,20 @@ func (rc *reqCount) saveStatusCodeCounts() {
 	)
 }
 
+// wait for the pending status codes to be counted, then save them
+func (rc *reqCount) flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for len(rc.chStatusCode) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rc.statusCodeRWLock.RLock()
+	data, _ := json.Marshal(rc.statusCodes)
+	rc.statusCodeRWLock.RUnlock()
+
+	return db.Put([]byte("reqStatusCodeCounts"), data, nil)
+}
+
 func (rc *reqCount) worker() {
 	rc.loadStatusCode()
 
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func (appCtx *AppContext) fileTTL(file *File) time.Duration {
+	conf := appCtx.conf()
+	ttl := file.TTL
+
+	if ttl < 0 {
+		if file.Type == fileTypeNotFound || file.err != nil {
+			ttl = conf.negativeTTL
+		} else {
+			ttl = conf.cacheTTL
+		}
+	}
+
+	if ttl > conf.maxCacheTTL {
+		ttl = conf.maxCacheTTL
+	}
+
+	return ttl
+}
+
+func (appCtx *AppContext) isExpired(file *File) bool {
+	// the overload file has no fetch time
+	return !file.FetchTime.IsZero() && time.Since(file.FetchTime) > appCtx.fileTTL(file)
+}
+
+// whether the expired file can still be served stale, it can't once it's expired for longer than the maxStale,
+// the file with the zero ttl is fetched for every request
+func (appCtx *AppContext) canServeStale(file *File) bool {
+	conf := appCtx.conf()
+	return conf.ServeStale && file.TTL != 0 && time.Since(file.FetchTime)-appCtx.fileTTL(file) <= time.Duration(conf.MaxStale)*time.Second
+}
+
+// the file is expired or its last revalidation failed
+func (appCtx *AppContext) isStale(file *File) bool {
+	return atomic.LoadInt32(&file.stale) == 1 || appCtx.isExpired(file)
+}
+
+// how long since the stale file was fetched, 0 if the file is fresh
+func (appCtx *AppContext) staleAge(file *File) time.Duration {
+	if !appCtx.isStale(file) {
+		return 0
+	}
+
+	return time.Since(file.FetchTime)
+}
+
+func (appCtx *AppContext) setStaleAge(ctx *fasthttp.RequestCtx, file *File) {
+	if age := appCtx.staleAge(file); age > 0 {
+		ctx.Response.Header.Set(staleAgeHeader, strconv.FormatInt(int64(age/time.Second), 10))
+	}
+}
+
+func (appCtx *AppContext) restoreFiles() {
+	appCtx.fileStore.load(func(key string, file *File) {
+		appCtx.cache.Set(key, file)
+
+		if uri, header := parseVariantKey(key); header != nil {
+			appCtx.variants.add(uri, key)
+		}
+	})
+}
+
+// the restored file has been checked against the backend
+func (appCtx *AppContext) markChecked(file *File, changed bool) {
+	if atomic.CompareAndSwapInt32(&file.restored, 1, 0) {
+		appCtx.fileStore.checked(changed)
+	}
+}
+
+// whether the fetched file differs from the cached one
+func fileChanged(file *File, newFile *File) bool {
+	return newFile.Type != file.Type ||
+		newFile.ModifyTime != file.ModifyTime ||
+		!bytes.Equal(newFile.ETag, file.ETag) ||
+		!bytes.Equal(newFile.Body, file.Body)
+}
+
+// only one revalidation will run for the same file at the same time
+func (appCtx *AppContext) revalidateAsync(uri string, file *File) {
+	if !atomic.CompareAndSwapInt32(&file.revalidating, 0, 1) {
+		return
+	}
+
+	go func() {
+		appCtx.revalidate(uri, file)
+		atomic.StoreInt32(&file.revalidating, 0)
+	}()
+}
+
+// fetch the file again, the cached one will be kept if the backend fails,
+// the failure will be retried by the overload monitor
+func (appCtx *AppContext) revalidate(uri string, file *File) {
+	newFile, err := appCtx.requestFile(uri, file)
+
+	if err != nil {
+		atomic.StoreInt32(&file.stale, 1)
+		return
+	}
+
+	changed := fileChanged(file, newFile)
+
+	appCtx.markChecked(file, changed)
+
+	if !changed {
+		// carry over the runtime states
+		newFile.Count = atomic.LoadUint64(&file.Count)
+		newFile.Cost = atomic.LoadUint64(&file.Cost)
+		newFile.JSONBody = file.JSONBody
+		newFile.dependents = file.dependents
+		appCtx.setFile(uri, newFile)
+		return
+	}
+
+	if newFile.Type == fileTypeProxy {
+		appCtx.proxyMap.Set(uri, newFile)
+	}
+	appCtx.clearDependents(uri)
+	appCtx.dropVariants(uri)
+	appCtx.setFile(uri, newFile)
+	appCtx.runtimeCache.flush(uri)
+}
+
+// keep the cached file and serve it stale if the backend failed to update it
+func (appCtx *AppContext) keepStale(uri string) bool {
+	if !appCtx.conf().ServeStale {
+		return false
+	}
+
+	value, has := appCtx.cache.Peek(uri)
+	if !has {
+		return false
+	}
+
+	file := value.(*File)
+	if !file.fetched() {
+		return false
+	}
+
+	atomic.StoreInt32(&file.stale, 1)
+	return true
+}
+
+// the handler of the overload monitor when the backend failed on the uri
+func (appCtx *AppContext) retryFile(uri string) {
+	if appCtx.conf().ServeStale {
+		value, has := appCtx.cache.Peek(uri)
+		if has && value.(*File).fetched() {
+			appCtx.revalidateAsync(uri, value.(*File))
+			return
+		}
+	}
+
+	appCtx.delFile(uri)
+	appCtx.runtimeCache.flush(uri)
+}
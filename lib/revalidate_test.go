@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/portal/lib/utils"
+	"github.com/ysmood/umi"
+)
+
+func testAppContext() *AppContext {
+	conf := testConfig()
+	conf.NegativeTTL = 10
+	conf.MaxCacheTTL = 120
+	conf.validate()
+
+	appCtx := &AppContext{}
+	appCtx.config.Store(conf)
+	return appCtx
+}
+
+func TestFileExpire(t *testing.T) {
+	appCtx := testAppContext()
+	now := time.Now()
+
+	list := []struct {
+		name     string
+		file     *File
+		expired  bool
+		stale    bool
+		staleAge time.Duration
+	}{
+		{"fresh", &File{FetchTime: now.Add(-30 * time.Second), TTL: -1}, false, false, 0},
+		{"default ttl", &File{FetchTime: now.Add(-90 * time.Second), TTL: -1}, true, true, 90 * time.Second},
+		{"own ttl", &File{FetchTime: now.Add(-90 * time.Second), TTL: 100 * time.Second}, false, false, 0},
+		{"no cache", &File{FetchTime: now.Add(-time.Second), TTL: 0}, true, true, time.Second},
+		{"max ttl", &File{FetchTime: now.Add(-150 * time.Second), TTL: time.Hour}, true, true, 150 * time.Second},
+		{"not found", &File{FetchTime: now.Add(-20 * time.Second), TTL: -1, Type: fileTypeNotFound}, true, true, 20 * time.Second},
+		{"error", &File{FetchTime: now.Add(-20 * time.Second), TTL: -1, err: errBadAction}, true, true, 20 * time.Second},
+		{"failed revalidation", &File{FetchTime: now.Add(-30 * time.Second), TTL: -1, stale: 1}, false, true, 30 * time.Second},
+		{"no fetch time", &File{}, false, false, 0},
+	}
+
+	for _, c := range list {
+		assert.Equal(t, c.expired, appCtx.isExpired(c.file), c.name)
+		assert.Equal(t, c.stale, appCtx.isStale(c.file), c.name)
+		assert.InDelta(t, c.staleAge.Seconds(), appCtx.staleAge(c.file).Seconds(), 1, c.name)
+	}
+}
+
+func TestStaleAgeHeader(t *testing.T) {
+	appCtx := testAppContext()
+
+	ctx := &fasthttp.RequestCtx{}
+	appCtx.setStaleAge(ctx, &File{FetchTime: time.Now().Add(-30 * time.Second), TTL: -1})
+	assert.Nil(t, ctx.Response.Header.Peek(staleAgeHeader))
+
+	ctx = &fasthttp.RequestCtx{}
+	appCtx.setStaleAge(ctx, &File{FetchTime: time.Now().Add(-90 * time.Second), TTL: -1})
+	assert.Equal(t, "90", string(ctx.Response.Header.Peek(staleAgeHeader)))
+}
+
+func TestFileChanged(t *testing.T) {
+	file := newFile("a.com/b", map[string]string{"Portm-Id": "1", "Portm-Type": "Text"}, []byte("ok"))
+
+	assert.False(t, fileChanged(file, file.renewed()))
+	assert.False(t, fileChanged(file, newFile("a.com/b", map[string]string{"Portm-Id": "1", "Portm-Type": "Text"}, []byte("ok"))))
+	assert.True(t, fileChanged(file, newFile("a.com/b", map[string]string{"Portm-Id": "1", "Portm-Type": "Binary"}, []byte("ok"))))
+	assert.True(t, fileChanged(file, newFile("a.com/b", map[string]string{"Portm-Id": "1", "Portm-Type": "Text"}, []byte("new"))))
+}
+
+// the app context that fetches the files from the handler
+func testBackendContext(handler http.HandlerFunc) (*AppContext, func()) {
+	backend := httptest.NewServer(handler)
+
+	rc := &reqCount{chStatusCode: make(chan int, 100)}
+	go func() {
+		for range rc.chStatusCode {
+		}
+	}()
+
+	appCtx := testAppContext()
+	appCtx.cache = umi.New(nil)
+	appCtx.fileStore = newFileStore(0)
+	appCtx.backends = newBackendPool(strings.TrimPrefix(backend.URL, "http://"), "/", 0)
+	appCtx.reqCount = rc
+	appCtx.fetching = utils.NewFlightGroup()
+	appCtx.overload = 300
+	appCtx.overloadMointer = &overloadMonitor{action: make(chan *overloadMessage, 100)}
+	appCtx.runtimeCache = newRuntimeCache()
+
+	return appCtx, backend.Close
+}
+
+func TestMaxStale(t *testing.T) {
+	var fetches, failing int32
+	appCtx, clean := testBackendContext(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Portm-Type", "Text")
+		w.Write([]byte("new"))
+	})
+	defer clean()
+
+	appCtx.conf().ServeStale = true
+	appCtx.conf().MaxStale = 60
+
+	cached := func(age time.Duration) *File {
+		file := newFile("a.com/b", map[string]string{"Portm-Type": "Text"}, []byte("old"))
+		file.FetchTime = time.Now().Add(-age)
+		appCtx.cache.Set("a.com/b", file)
+		return file
+	}
+
+	// expired for 30s, within the maxStale
+	atomic.StoreInt32(&failing, 1)
+	file := cached(90 * time.Second)
+	got, cacheStatus := appCtx.lookupFile("a.com/b")
+	assert.Equal(t, cacheStale, cacheStatus)
+	assert.Equal(t, file, got)
+	for atomic.LoadInt32(&file.revalidating) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the failed fetch keeps the last good copy
+	got = appCtx.fetchFile("a.com/b")
+	assert.Equal(t, file, got)
+	value, _ := appCtx.cache.Peek("a.com/b")
+	assert.Equal(t, file, value)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&file.stale))
+
+	// expired for longer than the maxStale
+	atomic.StoreInt32(&failing, 0)
+	cached(200 * time.Second)
+	before := atomic.LoadInt32(&fetches)
+	got, cacheStatus = appCtx.lookupFile("a.com/b")
+	assert.Equal(t, cacheMiss, cacheStatus)
+	assert.Equal(t, "new", string(got.Body))
+	assert.Equal(t, before+1, atomic.LoadInt32(&fetches))
+}
+
+func TestNoCacheNotStale(t *testing.T) {
+	var fetches int32
+	appCtx, clean := testBackendContext(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Portm-Type", "Text")
+		w.Header().Set("Portm-Cache-TTL", "0")
+		w.Write([]byte("ok"))
+	})
+	defer clean()
+
+	appCtx.conf().ServeStale = true
+	appCtx.conf().MaxStale = 60
+
+	for i := int32(1); i <= 3; i++ {
+		_, cacheStatus := appCtx.lookupFile("a.com/b")
+		assert.Equal(t, cacheMiss, cacheStatus)
+		assert.Equal(t, i, atomic.LoadInt32(&fetches))
+	}
+}
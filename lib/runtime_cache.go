@@ -11,6 +11,7 @@ import (
 type runtimeCache struct {
 	lock  *sync.Mutex
 	cache *umi.Cache
+	stats hitCounter
 }
 
 type runtimeInfo struct {
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"hash/crc32"
 	"io"
 	"math/rand"
@@ -34,11 +35,8 @@ var randLock = &sync.Mutex{}
 
 var gispLock = &sync.Mutex{}
 
-const maxRequestBody = 1024 * 1024 // 1MB
-
-var httpClient = &http.Client{
-	Timeout: 3 * time.Second,
-}
+// the timeout is set on each request by the httpTimeout
+var httpClient = &http.Client{}
 
 func initRand() *rand.Rand {
 	hostname, err := os.Hostname()
@@ -111,6 +109,9 @@ func newSandbox() *gisp.Sandbox {
 
 			switch mode.(string) {
 			case "json":
+				if file.Large {
+					return largeFileBody(ctx, file)
+				}
 				if file.JSONBody == nil {
 					var err error
 					file.JSONBody, err = djson.Decode(file.Body)
@@ -162,6 +163,9 @@ func newSandbox() *gisp.Sandbox {
 			case "modifyTime":
 				return file.ModifyTime
 			default:
+				if file.Large {
+					return largeFileBody(ctx, file)
+				}
 				return file.Body
 			}
 		},
@@ -177,6 +181,7 @@ func newSandbox() *gisp.Sandbox {
 			}
 
 			list, has := env.appCtx.glob.Get(isDesc, pattern)
+			env.appCtx.glob.stats.record(has)
 
 			if has {
 				return clone(list)
@@ -185,7 +190,7 @@ func newSandbox() *gisp.Sandbox {
 			atomic.AddInt32(&env.appCtx.glob.count, 1)
 			defer atomic.AddInt32(&env.appCtx.glob.count, -1)
 
-			if env.appCtx.glob.count > env.appCtx.glob.overload {
+			if env.appCtx.glob.count > atomic.LoadInt32(&env.appCtx.glob.overload) {
 				return []interface{}{}
 			}
 
@@ -234,6 +239,7 @@ func newSandbox() *gisp.Sandbox {
 			key := ctx.ArgStr(1)
 
 			value, has := env.appCtx.runtimeCache.get(env.file.URI, key)
+			env.appCtx.runtimeCache.stats.record(has)
 
 			if has {
 				return clone(value)
@@ -286,6 +292,14 @@ func newSandbox() *gisp.Sandbox {
 				}
 			}
 
+			conf := ctx.ENV.(*gispEnv).appCtx.conf()
+
+			if conf.HTTPTimeout > 0 {
+				timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.HTTPTimeout)*time.Second)
+				defer cancel()
+				req = req.WithContext(timeoutCtx)
+			}
+
 			res, err := httpClient.Do(req)
 
 			if err != nil {
@@ -300,8 +314,8 @@ func newSandbox() *gisp.Sandbox {
 			for {
 				n, err := res.Body.Read(buf)
 				count += n
-				if count > maxRequestBody {
-					ctx.Error(fmt.Sprintf("max request body %v byte exceeded", maxRequestBody))
+				if count > conf.MaxRequestBody {
+					ctx.Error(fmt.Sprintf("max request body %v byte exceeded", conf.MaxRequestBody))
 				}
 				if err == io.EOF {
 					resBody = append(resBody, buf[0:n]...)
@@ -369,6 +383,21 @@ func newSandbox() *gisp.Sandbox {
 			return nil
 		},
 
+		// the time can be the timestamp in ms, the http date or the RFC3339 time
+		"setLastModified": func(ctx *gisp.Context) interface{} {
+			env := ctx.ENV.(*gispEnv)
+
+			switch val := ctx.Arg(1).(type) {
+			case float64:
+				env.lastModified = time.Unix(0, int64(val)*1000*1000)
+			case string:
+				env.lastModified = parseTime(val)
+			default:
+				ctx.Error("setLastModified: invalid time")
+			}
+			return nil
+		},
+
 		"setStatusCode": func(ctx *gisp.Context) interface{} {
 			env := ctx.ENV.(*gispEnv)
 
@@ -728,3 +757,9 @@ func newSandbox() *gisp.Sandbox {
 		"indexOf":  gispLib.IndexOf,
 	})
 }
+
+// the body of the large file is not held in memory, it can't be read by the script
+func largeFileBody(ctx *gisp.Context, file *File) interface{} {
+	ctx.Error("file is too large to read: " + file.URI)
+	return nil
+}
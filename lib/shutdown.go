@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Shutdown marks the app as draining, closes the listeners, waits for the active requests
+// to finish, such as the gisp executions and the proxies, then saves the runtime states to the db.
+// The draining is marked first, so that the keep-alive clients are told to reconnect to the other nodes.
+// It should be called before the CloseDb.
+func (appCtx *AppContext) Shutdown(closeListeners ...func()) {
+	atomic.StoreInt32(&appCtx.draining, 1)
+
+	for _, closeListener := range closeListeners {
+		closeListener()
+	}
+
+	fmt.Println("draining:", atomic.LoadInt32(&appCtx.activeCount))
+
+	deadline := time.Now().Add(appCtx.conf().drainTimeout)
+	for atomic.LoadInt32(&appCtx.activeCount) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&appCtx.activeCount); n > 0 {
+		fmt.Fprintln(os.Stderr, "drain timeout, active requests:", n)
+	}
+
+	logFlushError("request count", appCtx.reqCount.flush(time.Second))
+	logFlushError("cost", appCtx.cost.save())
+	logFlushError("warmup", appCtx.warmup.save())
+	logFlushError("log", appCtx.log.save())
+	logFlushError("access log", appCtx.flushAccessLog())
+	logFlushError("file store", appCtx.flushFileStore())
+
+	fmt.Println("shutdown")
+}
+
+func logFlushError(name string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "flush "+name+" error:\n"+err.Error())
+	}
+}
+
+// track an active request, the returned function ends it
+func (appCtx *AppContext) track() func() {
+	atomic.AddInt32(&appCtx.activeCount, 1)
+	return func() {
+		atomic.AddInt32(&appCtx.activeCount, -1)
+	}
+}
+
+func (appCtx *AppContext) flushAccessLog() error {
+	if appCtx.accessLog == nil {
+		return nil
+	}
+	return appCtx.accessLog.flush(time.Second)
+}
+
+// the cache writes queued by the requests are written before the db is closed
+func (appCtx *AppContext) flushFileStore() error {
+	if appCtx.fileStore == nil {
+		return nil
+	}
+	return appCtx.fileStore.stop(5 * time.Second)
+}
+
+func (appCtx *AppContext) isDraining() bool {
+	return atomic.LoadInt32(&appCtx.draining) == 1
+}
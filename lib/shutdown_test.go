@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysmood/umi"
+)
+
+func newShutdownContext(drainTimeout time.Duration) *AppContext {
+	appCtx := &AppContext{
+		reqCount:  newReqCount(),
+		cost:      newCostCache(),
+		log:       &logCache{cache: umi.New(nil)},
+		warmup:    newWarmup(),
+		fileStore: newFileStore(time.Hour),
+	}
+	appCtx.config.Store(&Config{drainTimeout: drainTimeout})
+	return appCtx
+}
+
+func TestShutdownDrain(t *testing.T) {
+	defer openTestDb(t)()
+
+	appCtx := newShutdownContext(time.Minute)
+	appCtx.warmup.record("a.com/b", &File{FetchTime: time.Now(), TTL: -1})
+	appCtx.fileStore.save("a.com/b", newFile("a.com/b", map[string]string{"Portm-Type": "Text"}, []byte("ok")))
+
+	done := appCtx.track()
+	closed := make(chan bool)
+	finished := make(chan bool)
+
+	go func() {
+		appCtx.Shutdown(func() {
+			// the keep-alive clients are told to reconnect before the listeners are closed
+			assert.True(t, appCtx.isDraining())
+			close(closed)
+		})
+		close(finished)
+	}()
+
+	<-closed
+
+	select {
+	case <-finished:
+		t.Fatal("the shutdown should wait for the active request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done()
+	<-finished
+
+	// the runtime states are saved for the next run
+	assert.Equal(t, []string{"a.com/b"}, newWarmup().top(10))
+
+	// the queued cache writes are flushed, the later ones are dropped
+	_, err := db.Get([]byte(fileStorePrefix+"a.com/b"), nil)
+	assert.Nil(t, err)
+	appCtx.fileStore.save("a.com/c", newFile("a.com/c", map[string]string{"Portm-Type": "Text"}, []byte("ok")))
+	assert.Equal(t, 0, len(appCtx.fileStore.chAction))
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	defer openTestDb(t)()
+
+	appCtx := newShutdownContext(20 * time.Millisecond)
+	appCtx.track()
+
+	startTime := time.Now()
+	appCtx.Shutdown()
+
+	assert.True(t, time.Since(startTime) < 10*time.Second)
+}
@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	subscribeOffsetKey  = "subscribeOffset"
+	subscribeMaxBackoff = 30 * time.Second
+	statusGone          = 410
+)
+
+// subscription keeps a long-lived connection to the change feed of the file service.
+// The feed is a server-sent events stream, each event looks like:
+//
+//	id: 1024
+//	data: {"action": "update", "uri": "http://a.com/b"}
+//
+// The id is the offset of the change, the feed should resume from the "offset" query,
+// it responds 410 if the offset is too old to resume.
+type subscription struct {
+	path          string
+	lock          *sync.Mutex
+	offset        string
+	connected     int32
+	reconnects    uint64
+	eventCount    uint64
+	lastEventTime int64
+}
+
+type changeEvent struct {
+	Action string `json:"action"`
+	URI    string `json:"uri"`
+}
+
+var errOffsetGone = errors.New("change feed offset is gone")
+
+// the empty path disables the subscription
+func newSubscription(path string) *subscription {
+	sub := &subscription{
+		path: path,
+		lock: &sync.Mutex{},
+	}
+
+	data, err := db.Get([]byte(subscribeOffsetKey), nil)
+	if err == nil {
+		sub.offset = string(data)
+	}
+
+	return sub
+}
+
+func (appCtx *AppContext) subscribe() {
+	sub := appCtx.subscription
+
+	if sub.path == "" {
+		return
+	}
+
+	backoff := time.Second
+
+	for {
+		startTime := time.Now()
+
+		err := appCtx.readChangeFeed()
+
+		atomic.StoreInt32(&sub.connected, 0)
+
+		if err == errOffsetGone {
+			// the missed changes are unknown, purge everything and start over
+			fmt.Fprintln(os.Stderr, "change feed offset gone:", sub.getOffset())
+			sub.setOffset("")
+			appCtx.purgeAll()
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "change feed error:\n"+err.Error())
+		}
+
+		if time.Since(startTime) > subscribeMaxBackoff {
+			backoff = time.Second
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > subscribeMaxBackoff {
+			backoff = subscribeMaxBackoff
+		}
+
+		atomic.AddUint64(&sub.reconnects, 1)
+	}
+}
+
+func (appCtx *AppContext) readChangeFeed() error {
+	sub := appCtx.subscription
+
+	offset := sub.getOffset()
+
+	query := ""
+	if offset != "" {
+		query = "offset=" + url.QueryEscape(offset)
+	}
+
+	res, err := appCtx.backends.get(sub.path, query, nil)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == statusGone {
+		return errOffsetGone
+	}
+
+	if res.StatusCode != 200 {
+		return errors.New("change feed status code " + strconv.Itoa(res.StatusCode))
+	}
+
+	atomic.StoreInt32(&sub.connected, 1)
+	fmt.Println("change feed connected, offset:", offset)
+
+	err = readEvents(res.Body, appCtx.applyChangeEvent)
+	if err == nil {
+		err = errors.New("change feed closed")
+	}
+	return err
+}
+
+// read the server-sent events, the lines of data of an event are joined by "\n",
+// the incomplete event at the end of the stream is dropped, the reading stops at the error of the fn
+func readEvents(r io.Reader, fn func(id string, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var id string
+	var data []string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if len(data) > 0 {
+				if err := fn(id, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			id = ""
+			data = nil
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "id:"):
+			id = eventValue(line[3:])
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, eventValue(line[5:]))
+		}
+	}
+
+	return scanner.Err()
+}
+
+// only one leading space of the field value is dropped
+func eventValue(value string) string {
+	return strings.TrimPrefix(value, " ")
+}
+
+// The offset isn't saved if the change failed to apply, such as the backend is down,
+// the error drops the connection, so that the change will be replayed after the reconnection.
+// The malformed events and the unknown actions are skipped.
+func (appCtx *AppContext) applyChangeEvent(id string, data string) error {
+	sub := appCtx.subscription
+
+	var event changeEvent
+	err := json.Unmarshal([]byte(data), &event)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "change event parse error:", data, err.Error())
+	} else {
+		err = appCtx.changeFile(event.Action, event.URI)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "change event error:", event.Action, event.URI, err.Error())
+		}
+		if err != nil && err != errBadAction {
+			return errors.New("change event " + id + " failed: " + err.Error())
+		}
+	}
+
+	atomic.AddUint64(&sub.eventCount, 1)
+	atomic.StoreInt64(&sub.lastEventTime, time.Now().UnixNano())
+
+	if id != "" {
+		sub.setOffset(id)
+	}
+
+	return nil
+}
+
+func (sub *subscription) getOffset() string {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	return sub.offset
+}
+
+func (sub *subscription) setOffset(offset string) {
+	sub.lock.Lock()
+	sub.offset = offset
+	sub.lock.Unlock()
+
+	db.Put([]byte(subscribeOffsetKey), []byte(offset), nil)
+}
+
+func (sub *subscription) status() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":       sub.path != "",
+		"connected":     atomic.LoadInt32(&sub.connected) == 1,
+		"offset":        sub.getOffset(),
+		"reconnects":    atomic.LoadUint64(&sub.reconnects),
+		"eventCount":    atomic.LoadUint64(&sub.eventCount),
+		"lastEventTime": atomic.LoadInt64(&sub.lastEventTime) / 1000 / 1000,
+	}
+}
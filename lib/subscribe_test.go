@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadEvents(t *testing.T) {
+	feed := ": comment\n" +
+		"id: 1\n" +
+		"data: {\"action\": \"update\",\n" +
+		"data:  \"uri\": \"a.com/b\"}\n" +
+		"\n" +
+		"\n" +
+		"id:2\r\n" +
+		"data:x\r\n" +
+		"\r\n" +
+		"data: no id\n" +
+		"\n" +
+		"id: 4\n" +
+		"data: incomplete\n"
+
+	type event struct{ id, data string }
+	list := []event{}
+
+	err := readEvents(strings.NewReader(feed), func(id string, data string) error {
+		list = append(list, event{id, data})
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []event{
+		{"1", "{\"action\": \"update\",\n \"uri\": \"a.com/b\"}"},
+		{"2", "x"},
+		{"", "no id"},
+	}, list)
+}
+
+func TestChangeFeedResume(t *testing.T) {
+	defer openTestDb(t)()
+
+	offsets := []string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset := r.URL.Query().Get("offset")
+		offsets = append(offsets, offset)
+
+		if offset == "gone" {
+			w.WriteHeader(statusGone)
+			return
+		}
+
+		// the unknown actions are skipped, but their offsets are still saved
+		w.Write([]byte("id: 7\ndata: {\"action\": \"noop\"}\n\nid: 8\ndata: {\"action\": \"noop\"}\n\n"))
+	}))
+	defer backend.Close()
+
+	appCtx := &AppContext{
+		backends:     newBackendPool(strings.TrimPrefix(backend.URL, "http://"), "/", 0),
+		subscription: newSubscription("/api/changes"),
+	}
+
+	assert.EqualError(t, appCtx.readChangeFeed(), "change feed closed")
+	assert.Equal(t, "8", appCtx.subscription.getOffset())
+	assert.Equal(t, uint64(2), appCtx.subscription.eventCount)
+
+	// the next run resumes from the saved offset
+	appCtx.subscription = newSubscription("/api/changes")
+	assert.Equal(t, "8", appCtx.subscription.getOffset())
+	appCtx.readChangeFeed()
+
+	appCtx.subscription.setOffset("gone")
+	assert.Equal(t, errOffsetGone, appCtx.readChangeFeed())
+
+	assert.Equal(t, []string{"", "8", "gone"}, offsets)
+}
+
+func TestChangeFeedRetry(t *testing.T) {
+	defer openTestDb(t)()
+
+	appCtx, clean := testBackendContext(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/changes" {
+			w.Write([]byte("id: 7\ndata: {\"action\": \"noop\"}\n\nid: 8\ndata: {\"action\": \"update\", \"uri\": \"a.com/b\"}\n\n"))
+			return
+		}
+
+		// the backend is down
+		w.WriteHeader(500)
+	})
+	defer clean()
+
+	appCtx.conf().ServeStale = true
+	appCtx.subscription = newSubscription("/api/changes")
+	appCtx.cache.Set("a.com/b", newFile("a.com/b", map[string]string{"Portm-Type": "Text"}, []byte("ok")))
+
+	// the failed change isn't skipped, the next connection resumes from it
+	assert.EqualError(t, appCtx.readChangeFeed(), "change event 8 failed: file service status code 500")
+	assert.Equal(t, "7", appCtx.subscription.getOffset())
+}
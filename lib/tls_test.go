@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostSet(t *testing.T) {
+	set := newHostSet("a.com, *.B.com")
+
+	assert.True(t, set.has("a.com"))
+	assert.True(t, set.has("x.b.com"))
+	assert.False(t, set.has("b.com"))
+	assert.False(t, set.has("c.com"))
+	assert.True(t, newHostSet("*").has("c.com"))
+	assert.False(t, newHostSet("").has("c.com"))
+}
+
+func TestCertStoreGet(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "a.com"},
+		DNSNames:     []string{"a.com", "*.b.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	store := &certStore{lock: &sync.RWMutex{}, hosts: map[string]*tls.Certificate{}}
+	_, err = indexCert(store.hosts, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	assert.Nil(t, err)
+
+	for _, host := range []string{"a.com", "A.com", "x.b.com"} {
+		cert, err := store.get(&tls.ClientHelloInfo{ServerName: host})
+		assert.Nil(t, err)
+		assert.NotNil(t, cert)
+	}
+
+	_, err = store.get(&tls.ClientHelloInfo{ServerName: "c.com"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FlightGroup coalesces the concurrent calls of the same key into one call
+type FlightGroup struct {
+	lock  *sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg   sync.WaitGroup
+	val  interface{}
+	err  error
+	dups int // the calls waiting for the running one
+}
+
+// NewFlightGroup ...
+func NewFlightGroup() *FlightGroup {
+	return &FlightGroup{
+		lock:  &sync.Mutex{},
+		calls: map[string]*flightCall{},
+	}
+}
+
+// Do runs the fn only if there's no running call of the key,
+// otherwise waits for the running one and shares its result.
+// The panic of the fn is returned as the error to all the callers.
+func (g *FlightGroup) Do(key string, fn func() interface{}) (interface{}, error) {
+	g.lock.Lock()
+	if call, has := g.calls[key]; has {
+		call.dups++
+		g.lock.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	call.run(key, fn)
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	call.wg.Done()
+
+	return call.val, call.err
+}
+
+func (call *flightCall) run(key string, fn func() interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.err = fmt.Errorf("flight %s panic: %v", key, r)
+		}
+	}()
+
+	call.val = fn()
+}
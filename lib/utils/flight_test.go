@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wait until the n calls are waiting for the running call of the key
+func waitDups(g *FlightGroup, key string, n int) {
+	for {
+		g.lock.Lock()
+		dups := g.calls[key].dups
+		g.lock.Unlock()
+
+		if dups == n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	g := NewFlightGroup()
+	count := int32(0)
+	started := make(chan bool)
+	wait := make(chan bool)
+	wg := sync.WaitGroup{}
+
+	fn := func() interface{} {
+		atomic.AddInt32(&count, 1)
+		close(started)
+		<-wait
+		return "ok"
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			val, err := g.Do("a", fn)
+			assert.Nil(t, err)
+			assert.Equal(t, "ok", val)
+			wg.Done()
+		}()
+
+		if i == 0 {
+			<-started
+		}
+	}
+
+	waitDups(g, "a", 9)
+	close(wait)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), count)
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := NewFlightGroup()
+	started := make(chan bool)
+	wait := make(chan bool)
+	done := make(chan error)
+
+	go func() {
+		_, err := g.Do("a", func() interface{} {
+			close(started)
+			<-wait
+			panic("boom")
+		})
+		done <- err
+	}()
+
+	<-started
+	go func() {
+		val, err := g.Do("a", func() interface{} { return "ok" })
+		assert.Nil(t, val)
+		done <- err
+	}()
+
+	waitDups(g, "a", 1)
+	close(wait)
+
+	assert.EqualError(t, <-done, "flight a panic: boom")
+	assert.EqualError(t, <-done, "flight a panic: boom")
+
+	val, err := g.Do("a", func() interface{} { return "ok" })
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", val)
+}
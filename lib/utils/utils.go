@@ -9,6 +9,10 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Wait ...
@@ -16,9 +20,9 @@ func Wait(clean func()) {
 	finish := make(chan bool)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		// sig is a ^C, handle it
+		// sig is a ^C or a SIGTERM from the process manager, handle it
 		<-c
 		clean()
 		finish <- true
@@ -29,8 +33,13 @@ func Wait(clean func()) {
 
 // ETag ...
 func ETag(data []byte) []byte {
+	return ETagOfSum(crc32.ChecksumIEEE(data))
+}
+
+// ETagOfSum returns the same ETag as the ETag func from the crc32 IEEE checksum
+func ETagOfSum(sum uint32) []byte {
 	return []byte("W/\"" +
-		strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 36) +
+		strconv.FormatUint(uint64(sum), 36) +
 		"\"")
 }
 
@@ -130,6 +139,19 @@ func LookupIntEnv(key string, defaultVal int) int {
 	return defaultVal
 }
 
+// LookupBoolEnv ...
+func LookupBoolEnv(key string, defaultVal bool) bool {
+	s, has := os.LookupEnv(key)
+
+	if has {
+		b, err := strconv.ParseBool(s)
+		if err == nil {
+			return b
+		}
+	}
+	return defaultVal
+}
+
 // Slicer ...
 func Slicer(left int, limit int, max int, maxLimit int) (int, int) {
 	if left < 0 {
@@ -182,6 +204,66 @@ func Gzip(data []byte) []byte {
 	return buf.Bytes()
 }
 
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+
+// Brotli compress data
+func Brotli(data []byte) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, 9)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// Zstd compress data
+func Zstd(data []byte) []byte {
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
+// NegotiateEncoding chooses one of the encodings by the q-values of the Accept-Encoding header.
+// When the q-values are equal, the former one of the encodings wins.
+// Returns empty string if none of them is acceptable.
+func NegotiateEncoding(acceptEncoding string, encodings []string) string {
+	qs := map[string]float64{}
+
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		qs[name] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+
+	for _, encoding := range encodings {
+		q, has := qs[encoding]
+		if !has {
+			q, has = qs["*"]
+		}
+
+		if has && q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
 // IsTextMIME ...
 func IsTextMIME(contentType string) bool {
 	t, _, _ := mime.ParseMediaType(contentType)
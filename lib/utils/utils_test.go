@@ -27,3 +27,14 @@ func TestCompareVersion(t *testing.T) {
 	assert.Equal(t, 1, utils.CompareVersion("1.2", "1"))
 	assert.Equal(t, -1, utils.CompareVersion("2", "3"))
 }
+
+func TestNegotiateEncoding(t *testing.T) {
+	list := []string{"br", "zstd", "gzip"}
+
+	assert.Equal(t, "br", utils.NegotiateEncoding("gzip, deflate, br", list))
+	assert.Equal(t, "gzip", utils.NegotiateEncoding("gzip;q=1.0, br;q=0.5", list))
+	assert.Equal(t, "gzip", utils.NegotiateEncoding("br;q=0, gzip", list))
+	assert.Equal(t, "br", utils.NegotiateEncoding("*", list))
+	assert.Equal(t, "", utils.NegotiateEncoding("deflate", list))
+	assert.Equal(t, "", utils.NegotiateEncoding("", list))
+}
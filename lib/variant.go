@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// the variant key looks like "http://a.com/b#vary:Accept-Language=en",
+// the uri never contains "#", and the values are escaped, so it won't be cut as the query
+const variantSep = "#vary:"
+
+// variantIndex tracks the variant keys of each uri, so that they can be
+// invalidated with the uri, and the number of them can be bounded
+type variantIndex struct {
+	lock *sync.RWMutex
+	max  int
+	dict map[string][]string // uri -> variant keys, the least recently added first
+}
+
+func newVariantIndex(max int) *variantIndex {
+	return &variantIndex{
+		lock: &sync.RWMutex{},
+		max:  max,
+		dict: map[string][]string{},
+	}
+}
+
+func (index *variantIndex) has(uri string, key string) bool {
+	for _, k := range index.dict[uri] {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the keys evicted for the bound, the known keys only take the read lock
+func (index *variantIndex) add(uri string, key string) []string {
+	index.lock.RLock()
+	known := index.has(uri, key)
+	index.lock.RUnlock()
+
+	if known {
+		return nil
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if index.has(uri, key) {
+		return nil
+	}
+
+	list := append(index.dict[uri], key)
+
+	var evicted []string
+	if index.max > 0 && len(list) > index.max {
+		evicted = append(evicted, list[:len(list)-index.max]...)
+		list = append([]string{}, list[len(list)-index.max:]...)
+	}
+
+	index.dict[uri] = list
+
+	return evicted
+}
+
+func (index *variantIndex) drop(uri string) []string {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	list := index.dict[uri]
+	delete(index.dict, uri)
+	return list
+}
+
+func (index *variantIndex) purge() {
+	index.lock.Lock()
+	index.dict = map[string][]string{}
+	index.lock.Unlock()
+}
+
+// parse the Portm-Vary header, such as "Accept-Language, X-Device"
+func parseVary(value string) []string {
+	list := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			list = append(list, textproto.CanonicalMIMEHeaderKey(name))
+		}
+	}
+	return list
+}
+
+func variantKey(uri string, vary []string, ctx *fasthttp.RequestCtx) string {
+	values := url.Values{}
+	for _, name := range vary {
+		values.Set(name, string(ctx.Request.Header.Peek(name)))
+	}
+	return uri + variantSep + values.Encode()
+}
+
+// split the cache key into the uri and the request headers to fetch the variant
+func parseVariantKey(key string) (string, http.Header) {
+	index := strings.Index(key, variantSep)
+	if index < 0 {
+		return key, nil
+	}
+
+	header := http.Header{}
+	values, _ := url.ParseQuery(key[index+len(variantSep):])
+	for name, list := range values {
+		header[name] = list
+	}
+
+	return key[:index], header
+}
+
+// whether the request has none of the headers named by the Portm-Vary
+func withoutVary(vary []string, ctx *fasthttp.RequestCtx) bool {
+	for _, name := range vary {
+		if len(ctx.Request.Header.Peek(name)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The variant of the file for the request headers named by the Portm-Vary, and its cache status.
+// The file is fetched without the headers, so a fresh one is reused as the variant of the request without them.
+func (appCtx *AppContext) getVariant(uri string, file *File, cacheStatus string, ctx *fasthttp.RequestCtx) (*File, string) {
+	key := variantKey(uri, file.Vary, ctx)
+
+	for _, k := range appCtx.variants.add(uri, key) {
+		appCtx.delFile(k)
+	}
+
+	// the disk file of a large file belongs to one cache entry
+	if cacheStatus == cacheMiss && !file.Large && withoutVary(file.Vary, ctx) {
+		variant := file.renewed()
+		variant.dependents = newDependentSet()
+		appCtx.setFile(key, variant)
+		return variant, cacheMiss
+	}
+
+	return appCtx.lookupFile(key)
+}
+
+// remove all the variants of the uri from the cache
+func (appCtx *AppContext) dropVariants(uri string) {
+	for _, key := range appCtx.variants.drop(uri) {
+		appCtx.delFile(key)
+	}
+}
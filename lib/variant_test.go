@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/ysmood/portal/lib/utils"
+	"github.com/ysmood/umi"
+)
+
+func TestVariantKey(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Accept-Language", "en?q=1")
+
+	vary := parseVary("accept-language, x-device")
+	assert.Equal(t, []string{"Accept-Language", "X-Device"}, vary)
+
+	key := variantKey("http://a.com/b", vary, ctx)
+	path, _ := utils.GetURIPath(key)
+	assert.Equal(t, key, path)
+
+	uri, header := parseVariantKey(key)
+	assert.Equal(t, "http://a.com/b", uri)
+	assert.Equal(t, "en?q=1", header.Get("Accept-Language"))
+	assert.Equal(t, "", header.Get("X-Device"))
+
+	uri, header = parseVariantKey("http://a.com/b")
+	assert.Equal(t, "http://a.com/b", uri)
+	assert.Nil(t, header)
+}
+
+func TestVariantIndex(t *testing.T) {
+	index := newVariantIndex(2)
+
+	assert.Nil(t, index.add("a", "a#1"))
+	assert.Nil(t, index.add("a", "a#2"))
+	assert.Nil(t, index.add("a", "a#2"))
+	assert.Equal(t, []string{"a#1"}, index.add("a", "a#3"))
+	assert.Equal(t, []string{"a#2", "a#3"}, index.drop("a"))
+	assert.Nil(t, index.drop("a"))
+}
+
+func TestGetVariant(t *testing.T) {
+	fetches := int32(0)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Portm-Type", "Text")
+		w.Header().Set("Portm-Vary", "Accept-Language")
+		w.Write([]byte("lang:" + r.Header.Get("Accept-Language")))
+	}))
+	defer backend.Close()
+
+	rc := &reqCount{chStatusCode: make(chan int, 100)}
+	go func() {
+		for range rc.chStatusCode {
+		}
+	}()
+
+	appCtx := &AppContext{
+		cache:        umi.New(nil),
+		fileStore:    newFileStore(0),
+		backends:     newBackendPool(strings.TrimPrefix(backend.URL, "http://"), "/", 0),
+		reqCount:     rc,
+		fetching:     utils.NewFlightGroup(),
+		overload:     300,
+		runtimeCache: newRuntimeCache(),
+		variants:     newVariantIndex(2),
+	}
+	appCtx.config.Store(&Config{
+		cacheTTL:    time.Minute,
+		maxCacheTTL: time.Minute,
+		negativeTTL: time.Minute,
+	})
+
+	get := func(lang string) (string, string) {
+		ctx := &fasthttp.RequestCtx{}
+		if lang != "" {
+			ctx.Request.Header.Set("Accept-Language", lang)
+		}
+
+		file, cacheStatus := appCtx.lookupFile("a.com/b")
+		file, cacheStatus = appCtx.getVariant("a.com/b", file, cacheStatus, ctx)
+		return string(file.Body), cacheStatus
+	}
+
+	// the fetch of the file is reused as the variant of the request without the headers
+	body, cacheStatus := get("")
+	assert.Equal(t, "lang:", body)
+	assert.Equal(t, cacheMiss, cacheStatus)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	body, cacheStatus = get("")
+	assert.Equal(t, "lang:", body)
+	assert.Equal(t, cacheHit, cacheStatus)
+
+	body, cacheStatus = get("en")
+	assert.Equal(t, "lang:en", body)
+	assert.Equal(t, cacheMiss, cacheStatus)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// the variants are dropped with the file
+	appCtx.dropVariants("a.com/b")
+	_, has := appCtx.cache.Peek(variantKey("a.com/b", []string{"Accept-Language"}, &fasthttp.RequestCtx{}))
+	assert.False(t, has)
+}
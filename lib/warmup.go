@@ -0,0 +1,313 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	warmupTopKey      = "warmupTopURIs"
+	warmupTopSize     = 1000
+	warmupMaxParallel = 100
+
+	// the max uris counted between two saves, the new ones beyond it are ignored
+	warmupMaxCounted = 10 * warmupTopSize
+
+	// the scores are multiplied by it on every save, so that they halve in about an hour
+	warmupDecay = 0.99
+)
+
+type warmup struct {
+	lock *sync.Mutex
+	job  *warmupJob
+
+	statsLock *sync.Mutex
+	counts    map[string]uint64  // the requests of the uris since the last save
+	scores    map[string]float64 // the decayed request counts, the top ones are kept across the restarts
+}
+
+// the persisted score of a uri
+type warmupScore struct {
+	URI   string  `json:"uri"`
+	Score float64 `json:"score"`
+}
+
+type warmupJob struct {
+	lock      *sync.Mutex
+	Total     int               `json:"total"`
+	Done      int               `json:"done"`
+	Failed    int               `json:"failed"`
+	Failures  map[string]string `json:"failures"`
+	Running   bool              `json:"running"`
+	StartTime int64             `json:"startTime"`
+	EndTime   int64             `json:"endTime"`
+}
+
+type warmupOptions struct {
+	URIs     []string `json:"uris"`
+	Pattern  string   `json:"pattern"`
+	Top      int      `json:"top"`
+	Parallel int      `json:"parallel"`
+}
+
+func newWarmup() *warmup {
+	w := &warmup{
+		lock:      &sync.Mutex{},
+		statsLock: &sync.Mutex{},
+		counts:    map[string]uint64{},
+		scores:    map[string]float64{},
+	}
+
+	data, err := db.Get([]byte(warmupTopKey), nil)
+	if err == nil {
+		list := []warmupScore{}
+		json.Unmarshal(data, &list)
+		for _, item := range list {
+			w.scores[item.URI] = item.Score
+		}
+	}
+
+	return w
+}
+
+// count a request of the uri, the failures and the not found files are not counted
+func (w *warmup) record(uri string, file *File) {
+	if w == nil || file == nil || !file.fetched() || file.Type == fileTypeNotFound {
+		return
+	}
+
+	w.statsLock.Lock()
+	if _, has := w.counts[uri]; has || len(w.counts) < warmupMaxCounted {
+		w.counts[uri]++
+	}
+	w.statsLock.Unlock()
+}
+
+// remember the most requested uris, so that the next run can warm them up
+func (appCtx *AppContext) topURIsWorker() {
+	for {
+		time.Sleep(time.Minute)
+
+		appCtx.warmup.save()
+	}
+}
+
+// merge the counts since the last save into the decayed scores, then persist the top ones
+func (w *warmup) save() error {
+	w.statsLock.Lock()
+
+	for uri, score := range w.scores {
+		w.scores[uri] = score * warmupDecay
+	}
+	for uri, count := range w.counts {
+		w.scores[uri] += float64(count)
+	}
+	w.counts = map[string]uint64{}
+
+	list := w.rank()
+	if len(list) > warmupTopSize {
+		list = list[:warmupTopSize]
+	}
+
+	w.scores = map[string]float64{}
+	for _, item := range list {
+		w.scores[item.URI] = item.Score
+	}
+
+	w.statsLock.Unlock()
+
+	data, _ := json.Marshal(list)
+
+	return db.Put([]byte(warmupTopKey), data, nil)
+}
+
+// the scores in descending order, the caller should hold the statsLock
+func (w *warmup) rank() []warmupScore {
+	list := make([]warmupScore, 0, len(w.scores))
+	for uri, score := range w.scores {
+		list = append(list, warmupScore{uri, score})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score == list[j].Score {
+			return list[i].URI < list[j].URI
+		}
+		return list[i].Score > list[j].Score
+	})
+
+	return list
+}
+
+// the n most requested uris
+func (w *warmup) top(n int) []string {
+	w.statsLock.Lock()
+	list := w.rank()
+	w.statsLock.Unlock()
+
+	if n < len(list) {
+		list = list[:n]
+	}
+
+	uris := make([]string, len(list))
+	for i, item := range list {
+		uris[i] = item.URI
+	}
+	return uris
+}
+
+func (appCtx *AppContext) warmupURIs(opts *warmupOptions) ([]string, error) {
+	uris := append([]string{}, opts.URIs...)
+
+	if opts.Pattern != "" {
+		var list []string
+		patternJSON, _ := json.Marshal(opts.Pattern)
+		err := appCtx.rpc(&list, `["globFile", `+string(patternJSON)+`, "desc"]`)
+
+		if err != nil {
+			return nil, err
+		}
+
+		uris = append(uris, list...)
+	}
+
+	if opts.Top > 0 {
+		uris = append(uris, appCtx.warmup.top(opts.Top)...)
+	}
+
+	return uris, nil
+}
+
+func (appCtx *AppContext) startWarmup(opts *warmupOptions) (*warmupJob, error) {
+	uris, err := appCtx.warmupURIs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	appCtx.warmup.lock.Lock()
+	defer appCtx.warmup.lock.Unlock()
+
+	if appCtx.warmup.job != nil && appCtx.warmup.job.isRunning() {
+		return nil, errors.New("warmup is running")
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 10
+	}
+	if parallel > warmupMaxParallel {
+		parallel = warmupMaxParallel
+	}
+
+	job := &warmupJob{
+		lock:      &sync.Mutex{},
+		Total:     len(uris),
+		Failures:  map[string]string{},
+		Running:   true,
+		StartTime: time.Now().UnixNano() / 1000 / 1000,
+	}
+	appCtx.warmup.job = job
+
+	ch := make(chan string)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			for uri := range ch {
+				file := appCtx.fetchFile(uri)
+
+				if file.Type == fileTypeProxy {
+					appCtx.proxyMap.Set(uri, file)
+				}
+
+				job.lock.Lock()
+				if file.err != nil {
+					job.Failed++
+					job.Failures[uri] = file.err.Error()
+				}
+				job.Done++
+				job.lock.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		for _, uri := range uris {
+			ch <- uri
+		}
+		close(ch)
+		wg.Wait()
+
+		job.lock.Lock()
+		job.Running = false
+		job.EndTime = time.Now().UnixNano() / 1000 / 1000
+		job.lock.Unlock()
+
+		fmt.Println("warmup done:", job.Total)
+	}()
+
+	fmt.Println("warmup start:", job.Total)
+
+	return job, nil
+}
+
+func (job *warmupJob) isRunning() bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return job.Running
+}
+
+func (job *warmupJob) marshal() []byte {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	data, _ := json.Marshal(job)
+	return data
+}
+
+// curl -d '{"uris": ["a.com/b"], "pattern": "^a.com/c", "top": 100, "parallel": 10}' 127.0.0.1:7071/warmup
+func (appCtx *AppContext) handleWarmup(ctx *fasthttp.RequestCtx) {
+	opts := &warmupOptions{}
+	err := json.Unmarshal(ctx.PostBody(), opts)
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	job, err := appCtx.startWarmup(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warmup error:", err.Error())
+		ctx.Error(err.Error(), 400)
+		return
+	}
+
+	data := job.marshal()
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(data)
+}
+
+func (appCtx *AppContext) warmupStatus(ctx *fasthttp.RequestCtx) {
+	appCtx.warmup.lock.Lock()
+	job := appCtx.warmup.job
+	appCtx.warmup.lock.Unlock()
+
+	var data []byte
+	if job == nil {
+		data = []byte("null")
+	} else {
+		data = job.marshal()
+	}
+
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(data)
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmupRank(t *testing.T) {
+	defer openTestDb(t)()
+
+	w := newWarmup()
+	ok := &File{FetchTime: time.Now(), TTL: -1}
+
+	for i := 0; i < 3; i++ {
+		w.record("a.com/a", ok)
+	}
+	w.record("a.com/b", ok)
+	w.record("a.com/b", ok)
+	w.record("a.com/c", &File{FetchTime: time.Now(), TTL: -1, Type: fileTypeNotFound})
+	w.record("a.com/d", newErrorFile("error", errBadAction))
+	w.record("a.com/e", overloadFile)
+
+	assert.Nil(t, w.save())
+	assert.Equal(t, []string{"a.com/a", "a.com/b"}, w.top(10))
+	assert.Equal(t, []string{"a.com/a"}, w.top(1))
+
+	// the re-fetch of a file doesn't reset its count
+	for i := 0; i < 4; i++ {
+		w.record("a.com/b", &File{FetchTime: time.Now(), TTL: -1})
+	}
+	assert.Nil(t, w.save())
+	assert.Equal(t, []string{"a.com/b", "a.com/a"}, w.top(10))
+	assert.InDelta(t, 3*warmupDecay, w.scores["a.com/a"], 0.001)
+
+	// the next run starts from the previous list and merges the new counts into it
+	next := newWarmup()
+	assert.Equal(t, []string{"a.com/b", "a.com/a"}, next.top(10))
+
+	next.record("a.com/f", ok)
+	assert.Nil(t, next.save())
+	assert.Equal(t, []string{"a.com/b", "a.com/a", "a.com/f"}, next.top(10))
+}
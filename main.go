@@ -1,19 +1,31 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/ysmood/portal/lib"
 	"github.com/ysmood/portal/lib/utils"
 )
 
 func main() {
+	// portal config check [flags] [file]
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		err := lib.CheckConfig(os.Args[3:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	appCtx := lib.NewAppContext()
 
 	closeControlService := appCtx.ControlService()
 	closeFileService := appCtx.FileService()
 
 	utils.Wait(func() {
-		closeControlService()
-		closeFileService()
+		appCtx.Shutdown(closeControlService, closeFileService)
 		lib.CloseDb()
 	})
 }